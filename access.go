@@ -0,0 +1,172 @@
+package hdproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type (
+	// AccessConfig restricts which clients may use the proxy, by IP or CIDR e.g. "10.0.0.0/8" or "::1".
+	AccessConfig struct {
+		// Allow lists the only clients allowed, everyone when empty.
+		Allow []string
+		// Deny lists clients denied, even if allowed.
+		Deny []string
+		// TrustedProxies are load balancers & the like whose X-Forwarded-For is believed,
+		// the client is the last address in it that's not a trusted proxy.
+		TrustedProxies []string
+	}
+
+	// accessList checks client IPs against AccessConfig, nil when anyone is allowed.
+	accessList struct {
+		// denied first, 64-bit atomic must be aligned on 32-bit platforms
+		denied  uint64
+		allow   []*net.IPNet
+		deny    []*net.IPNet
+		trusted []*net.IPNet
+	}
+)
+
+func (c AccessConfig) validate(errs *ConfigErrors) {
+	check := func(key string, list []string) {
+		for i, s := range list {
+			if _, err := parseCIDR(s); err != nil {
+				errs.add(key+"."+strconv.Itoa(i), "%v", err)
+			}
+		}
+	}
+	check("access.allow", c.Allow)
+	check("access.deny", c.Deny)
+	check("access.trustedproxies", c.TrustedProxies)
+}
+
+// parseCIDR parses s as CIDR, a single IP is the network of just that address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, result, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return result, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+func newAccessList(config AccessConfig) (*accessList, error) {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 && len(config.TrustedProxies) == 0 {
+		return nil, nil
+	}
+	var err error
+	result := &accessList{}
+	if result.allow, err = parseCIDRs(config.Allow); err != nil {
+		return nil, err
+	}
+	if result.deny, err = parseCIDRs(config.Deny); err != nil {
+		return nil, err
+	}
+	if result.trusted, err = parseCIDRs(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func containsIP(list []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range list {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client of r, taken from X-Forwarded-For when r comes from trusted proxies.
+// It's not an IP when unknown, e.g. for unix socket.
+func (a *accessList) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || a == nil || !containsIP(a.trusted, ip) {
+		return host
+	}
+	var forwarded []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			// can't go further than garbage
+			return hop
+		}
+		host = hop
+		if !containsIP(a.trusted, hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// allowed reports whether client IP may use the proxy, deny wins over allow.
+// Clients without IP, e.g. on unix socket, are only allowed when there's no list.
+func (a *accessList) allowed(client string) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// Denied returns how many requests were denied so far.
+func (a *accessList) Denied() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.denied)
+}
+
+// checkAccess answers 403 if the client of r is not allowed, returning the client IP otherwise.
+func (p *Proxy) checkAccess(w http.ResponseWriter, r *http.Request) (string, bool) {
+	client := p.access.clientIP(r)
+	if p.access.allowed(client) {
+		return client, true
+	}
+	atomic.AddUint64(&p.access.denied, 1)
+	p.logRejected(r, http.StatusForbidden, fmt.Sprintf("DENIED %s", client))
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return "", false
+}
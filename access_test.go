@@ -0,0 +1,65 @@
+package hdproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessList_ClientIP(t *testing.T) {
+	a, err := newAccessList(AccessConfig{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "1.2.3.4:5678", nil, "1.2.3.4"},
+		{"untrusted forwarded", "1.2.3.4:5678", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"trusted forwarded", "10.0.0.1:5678", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"spoofed first hop", "10.0.0.1:5678", []string{"9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"trusted chain", "10.0.0.1:5678", []string{"5.6.7.8, 192.168.1.1", "192.168.2.2"}, "5.6.7.8"},
+		{"all trusted", "10.0.0.1:5678", []string{"192.168.1.1"}, "192.168.1.1"},
+		{"trusted without header", "10.0.0.1:5678", nil, "10.0.0.1"},
+		{"ipv6", "[::1]:5678", nil, "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header["X-Forwarded-For"] = tt.forwarded
+			if got := a.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessList_Allowed(t *testing.T) {
+	a, err := newAccessList(AccessConfig{Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.0.13.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		want   bool
+	}{
+		{"10.1.2.3", true},
+		{"::1", true},
+		{"10.0.13.7", false},
+		{"11.0.0.1", false},
+		{"@", false},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(tt.client); got != tt.want {
+			t.Errorf("allowed(%q) = %v, want %v", tt.client, got, tt.want)
+		}
+	}
+	var open *accessList
+	if !open.allowed("1.2.3.4") {
+		t.Error("nil access list denied")
+	}
+}
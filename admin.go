@@ -0,0 +1,516 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+type (
+	AdminConfig struct {
+		// Addr to listen to, e.g. "127.0.0.1:9090", admin API is disabled when empty.
+		Addr string
+		// Token expected as "Authorization: Bearer <token>", random one is generated when empty.
+		Token string
+	}
+
+	// AdminServer is a REST API to inspect & change proxies at runtime:
+	//
+	//	GET    /proxies                                list proxies
+	//	POST   /proxies                                create & start a new proxy
+	//	GET    /proxies/{port}                         proxy settings
+	//	PATCH  /proxies/{port}                         update target, hold, noLog, breakpoints and/or listen (effective on next start)
+	//	POST   /proxies/{port}/start                   start listening
+	//	POST   /proxies/{port}/stop                    stop listening
+	//	GET    /proxies/{port}/exchanges               recent exchanges as HAR, filtered by ?method=, ?path=, ?limit=
+	//	GET    /proxies/{port}/exchanges/{id}          single exchange as HAR entry
+	//	GET    /proxies/{port}/exchanges/{id}/snippet  request as ?format=curl (default), httpie or http
+	//	POST   /proxies/{port}/exchanges/{id}/replay   send the request again, edited by optional ReplayEdits body
+	//	DELETE /proxies/{port}/cache                   drop cached responses
+	//	GET    /proxies/{port}/paused                  exchanges waiting at breakpoints
+	//	POST   /proxies/{port}/paused/{id}/resume      continue, edited by optional BreakpointAction body
+	//	POST   /proxies/{port}/paused/{id}/abort       answer the client with optional BreakpointAction status & body
+	//	GET    /proxies/{port}/gate                    gate settings & held requests
+	//	PUT    /proxies/{port}/gate                    enable, disable (releasing all) or change the gate
+	//	POST   /proxies/{port}/gate/release            release the oldest held request, ?count=n the n next ones, ?all=true all
+	//	POST   /proxies/{port}/gate/{id}/release       release a held request
+	AdminServer struct {
+		// DrainTimeout is how long stopping a proxy waits for requests & WebSockets in flight,
+		// DefaultDrainTimeout when not set.
+		DrainTimeout time.Duration
+
+		token   string
+		proxies *Proxies
+		srv     *http.Server
+	}
+
+	// adminProxy is the JSON representation of a proxy, also used to create & update one.
+	adminProxy struct {
+		Name   string  `json:"name,omitempty"`
+		Port   int     `json:"port"`
+		Listen *string `json:"listen,omitempty"`
+		// SocketMode is the unix socket permission in octal, e.g. "0660"
+		SocketMode *string `json:"socketMode,omitempty"`
+		// Addr is the actual address listened to, read only
+		Addr   string    `json:"addr,omitempty"`
+		Target *string   `json:"target,omitempty"`
+		Hold   *string   `json:"hold,omitempty"`
+		NoLog  *[]string `json:"noLog,omitempty"`
+		// Breakpoints replace the current ones, empty list to clear
+		Breakpoints *[]BreakpointConfig `json:"breakpoints,omitempty"`
+		Running     bool                `json:"running"`
+		// Denied is how many requests the access lists denied, read only
+		Denied uint64 `json:"denied"`
+	}
+
+	adminError struct {
+		Error string `json:"error"`
+	}
+)
+
+func NewAdminServer(config AdminConfig, proxies *Proxies) (*AdminServer, error) {
+	token := config.Token
+	if len(token) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("error generating admin token: %w", err)
+		}
+		token = hex.EncodeToString(b)
+	}
+	result := &AdminServer{
+		token:   token,
+		proxies: proxies,
+	}
+	result.srv = &http.Server{
+		Addr:    config.Addr,
+		Handler: result,
+	}
+	return result, nil
+}
+
+// Token returns the bearer token of the admin API, the generated one when AdminConfig.Token is not set.
+func (a *AdminServer) Token() string {
+	return a.token
+}
+
+func (a *AdminServer) Start() error {
+	return a.srv.ListenAndServe()
+}
+
+func (a *AdminServer) Shutdown(ctx context.Context) {
+	a.srv.Shutdown(ctx)
+}
+
+// stopProxy shuts p down, not bound to the admin request so a client going away doesn't cut the drain short.
+func (a *AdminServer) stopProxy(p *Proxy) {
+	timeout := a.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	p.Shutdown(ctx)
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != "Bearer" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		writeAdminError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+	// /proxies/{port}/{action}/{id}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "proxies" {
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			a.listProxies(w)
+		case http.MethodPost:
+			a.createProxy(w, r)
+		default:
+			writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", parts[1]))
+		return
+	}
+	p := a.proxies.Get(port)
+	if p == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("port %d not found", port))
+		return
+	}
+	route := r.Method + " " + strings.Join(append([]string{""}, parts[2:]...), "/")
+	switch {
+	case route == "GET ":
+		writeAdminJSON(w, http.StatusOK, toAdminProxy(p))
+	case route == "PATCH ":
+		a.updateProxy(w, r, p)
+	case route == "POST /start":
+		a.startProxy(w, p)
+	case route == "POST /stop":
+		a.stopProxy(p)
+		writeAdminJSON(w, http.StatusOK, toAdminProxy(p))
+	case route == "GET /exchanges":
+		a.listExchanges(w, r, p)
+	case len(parts) == 4 && route == "GET /exchanges/"+parts[3]:
+		a.getExchange(w, p, parts[3])
+	case len(parts) == 5 && route == "GET /exchanges/"+parts[3]+"/snippet":
+		a.getSnippet(w, r, p, parts[3])
+	case len(parts) == 5 && route == "POST /exchanges/"+parts[3]+"/replay":
+		a.replayExchange(w, r, p, parts[3])
+	case route == "GET /paused":
+		writeAdminJSON(w, http.StatusOK, p.Paused())
+	case len(parts) == 5 && parts[2] == "paused" && (parts[4] == "resume" || parts[4] == "abort") && r.Method == http.MethodPost:
+		a.resumeExchange(w, r, p, parts[3], parts[4] == "abort")
+	case route == "GET /gate":
+		writeAdminJSON(w, http.StatusOK, p.Gate())
+	case route == "PUT /gate":
+		a.updateGate(w, r, p)
+	case route == "POST /gate/release":
+		a.releaseGate(w, r, p)
+	case len(parts) == 5 && route == "POST /gate/"+parts[3]+"/release":
+		id, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request id %q", parts[3]))
+			return
+		}
+		if err = p.ReleaseHeld(id); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"released": 1})
+	case route == "DELETE /cache":
+		purged := p.cache.Purge()
+		fmt.Fprintln(p.logWriter, "admin: purged", purged, "cache entries of port", p.Port())
+		writeAdminJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (a *AdminServer) listProxies(w http.ResponseWriter) {
+	proxies := a.proxies.List()
+	result := make([]adminProxy, len(proxies))
+	for i, p := range proxies {
+		result[i] = toAdminProxy(p)
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (a *AdminServer) createProxy(w http.ResponseWriter, r *http.Request) {
+	var req adminProxy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Port < 0 || req.Target == nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("port and target are required"))
+		return
+	}
+	config := ProxyConfig{Name: req.Name, Port: req.Port}
+	if err := req.apply(&config); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	// port 0 picks any free port, it's known once listening, but stays 0 for unix socket
+	unix := strings.HasPrefix(config.Listen, unixPrefix)
+	if (req.Port > 0 || unix) && a.proxies.Get(req.Port) != nil {
+		writeAdminError(w, http.StatusConflict, fmt.Errorf("port %d already exists", req.Port))
+		return
+	}
+	p, err := NewProxy(config)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	// registered only once listening, so a port that can't be bound is not left behind
+	if err = a.serveProxy(p); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	a.proxies.Add(p)
+	writeAdminJSON(w, http.StatusOK, toAdminProxy(p))
+}
+
+func (a *AdminServer) updateProxy(w http.ResponseWriter, r *http.Request, p *Proxy) {
+	var req adminProxy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	config := p.Config()
+	if err := req.apply(&config); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	// validate everything first, so the update is all or nothing & swapped at once
+	if errs := config.Validate(); len(errs) > 0 {
+		writeAdminError(w, http.StatusBadRequest, errs)
+		return
+	}
+	if err := p.Update(config); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	fmt.Fprintln(p.logWriter, "admin: updated port", p.Port(), "target:", config.Target, "hold:", config.Hold, "noLog:", config.NoLog, "listen:", config.Listen)
+	writeAdminJSON(w, http.StatusOK, toAdminProxy(p))
+}
+
+func (a *AdminServer) startProxy(w http.ResponseWriter, p *Proxy) {
+	if err := a.serveProxy(p); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, toAdminProxy(p))
+}
+
+// serveProxy listens on the port of p & serves it in background.
+func (a *AdminServer) serveProxy(p *Proxy) error {
+	if err := p.Listen(); err != nil {
+		return err
+	}
+	go func() {
+		if err := p.Serve(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintln(p.logWriter, "Port", p.Port(), ":", err)
+		}
+	}()
+	config := p.Config()
+	fmt.Fprintln(p.logWriter, "admin: started port", config.Port, "->", config.Target, "hold:", config.Hold, "listen:", p.Addr())
+	return nil
+}
+
+func (a *AdminServer) listExchanges(w http.ResponseWriter, r *http.Request, p *Proxy) {
+	query := r.URL.Query()
+	method := query.Get("method")
+	path := query.Get("path")
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	entries := p.har.Entries()
+	result := make([]*harlog.Entry, 0, len(entries))
+	for _, e := range entries {
+		if len(method) > 0 && !strings.EqualFold(e.Request.Method, method) {
+			continue
+		}
+		if len(path) > 0 && !strings.Contains(e.Request.URL, path) {
+			continue
+		}
+		result = append(result, e)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	writeAdminJSON(w, http.StatusOK, HAR(result))
+}
+
+func (a *AdminServer) getExchange(w http.ResponseWriter, p *Proxy, id string) {
+	for _, e := range p.har.Entries() {
+		if e.ID == id {
+			writeAdminJSON(w, http.StatusOK, e)
+			return
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, fmt.Errorf("exchange %s not found", id))
+}
+
+// getSnippet writes the request of exchange id as text, rebuilt from its dump files.
+func (a *AdminServer) getSnippet(w http.ResponseWriter, r *http.Request, p *Proxy, id string) {
+	dumpID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid exchange id %q", id))
+		return
+	}
+	d, err := p.readDump(dumpID)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("exchange %s not found", id))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = SnippetCurl
+	}
+	var buf bytes.Buffer
+	if err = FormatSnippet(&buf, format, d, p.redact); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (a *AdminServer) replayExchange(w http.ResponseWriter, r *http.Request, p *Proxy, id string) {
+	dumpID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid exchange id %q", id))
+		return
+	}
+	var edits ReplayEdits
+	if r.ContentLength != 0 {
+		if err = json.NewDecoder(r.Body).Decode(&edits); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid replay edits: %w", err))
+			return
+		}
+	}
+	result, err := p.Replay(r.Context(), dumpID, edits)
+	if errors.Is(err, os.ErrNotExist) {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (a *AdminServer) resumeExchange(w http.ResponseWriter, r *http.Request, p *Proxy, id string, abort bool) {
+	exchangeID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid exchange id %q", id))
+		return
+	}
+	var action BreakpointAction
+	if r.ContentLength != 0 {
+		if err = json.NewDecoder(r.Body).Decode(&action); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid breakpoint action: %w", err))
+			return
+		}
+	}
+	err = p.Resume(exchangeID, action, abort)
+	if errors.Is(err, errNotPaused) {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+func (a *AdminServer) updateGate(w http.ResponseWriter, r *http.Request, p *Proxy) {
+	var req adminGate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	config := GateConfig{Enabled: req.Enabled, Path: req.Path}
+	if len(req.Timeout) > 0 {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %w", err))
+			return
+		}
+		config.Timeout = timeout
+	}
+	var errs ConfigErrors
+	if config.validate(&errs); len(errs) > 0 {
+		writeAdminError(w, http.StatusBadRequest, errs)
+		return
+	}
+	p.SetGate(config)
+	fmt.Fprintln(p.logWriter, "admin: updated gate of port", p.Port(), "enabled:", config.Enabled, "path:", config.Path, "timeout:", config.Timeout)
+	writeAdminJSON(w, http.StatusOK, p.Gate())
+}
+
+func (a *AdminServer) releaseGate(w http.ResponseWriter, r *http.Request, p *Proxy) {
+	query := r.URL.Query()
+	if all, _ := strconv.ParseBool(query.Get("all")); all {
+		writeAdminJSON(w, http.StatusOK, map[string]int{"released": p.ReleaseAll()})
+		return
+	}
+	count := 1
+	if s := query.Get("count"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid count %q", s))
+			return
+		}
+		count = n
+	}
+	released, credits := p.ReleaseNext(count)
+	writeAdminJSON(w, http.StatusOK, map[string]int{"released": released, "credits": credits})
+}
+
+func toAdminProxy(p *Proxy) adminProxy {
+	config := p.Config()
+	hold := config.Hold.String()
+	var socketMode *string
+	if config.SocketMode != 0 {
+		mode := fmt.Sprintf("%#o", uint32(config.SocketMode))
+		socketMode = &mode
+	}
+	return adminProxy{
+		Name:        config.Name,
+		Port:        config.Port,
+		Listen:      &config.Listen,
+		SocketMode:  socketMode,
+		Addr:        p.Addr(),
+		Target:      &config.Target,
+		Hold:        &hold,
+		NoLog:       &config.NoLog,
+		Breakpoints: &config.Breakpoints,
+		Running:     p.Running(),
+		Denied:      p.access.Denied(),
+	}
+}
+
+// apply sets the fields present in the request to config.
+func (r adminProxy) apply(config *ProxyConfig) error {
+	if r.Listen != nil {
+		config.Listen = strings.TrimSpace(*r.Listen)
+	}
+	if r.SocketMode != nil {
+		mode, err := strconv.ParseUint(*r.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socketMode: %w", err)
+		}
+		config.SocketMode = os.FileMode(mode)
+	}
+	if r.Target != nil {
+		config.Target = strings.TrimSpace(*r.Target)
+	}
+	if r.Hold != nil {
+		hold, err := time.ParseDuration(*r.Hold)
+		if err != nil {
+			return fmt.Errorf("invalid hold: %w", err)
+		}
+		config.Hold = hold
+	}
+	if r.NoLog != nil {
+		config.NoLog = *r.NoLog
+	}
+	if r.Breakpoints != nil {
+		config.Breakpoints = *r.Breakpoints
+	}
+	return nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		log.Println("admin: error writing response", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
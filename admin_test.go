@@ -0,0 +1,35 @@
+package hdproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminServer_Token(t *testing.T) {
+	a, err := NewAdminServer(AdminConfig{Token: "secret"}, NewProxies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/proxies", nil)
+		if len(tt.authorization) > 0 {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Authorization %q got %d, want %d", tt.authorization, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package hdproxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Methods a request can pass the auth gate with.
+const (
+	authBasic  = "basic"
+	authBearer = "bearer"
+	authMTLS   = "mtls"
+)
+
+type (
+	// AuthConfig gates the proxy port, a request passes with any of the configured methods.
+	AuthConfig struct {
+		// Basic users as "name:password".
+		Basic []string
+		// Bearer tokens as "name:token", name is the identity logged.
+		Bearer []string
+		// ClientCA is the PEM file of CAs verifying client certificates, identity is the subject common name.
+		// It requires TLS.
+		ClientCA string
+		// Header carrying basic & bearer credentials, default to Authorization.
+		// It's stripped before forwarding, so use another one if target has its own authentication.
+		Header string
+	}
+
+	// authGate checks the credentials of incoming requests, nil when the port is open to anyone.
+	authGate struct {
+		basic  map[string]string // name -> password
+		bearer map[string]string // token -> name
+		mtls   bool
+		header string
+	}
+)
+
+func (c AuthConfig) enabled() bool {
+	return len(c.Basic) > 0 || len(c.Bearer) > 0 || len(c.ClientCA) > 0
+}
+
+func (c AuthConfig) validate(tlsEnabled bool, errs *ConfigErrors) {
+	for i, user := range c.Basic {
+		if name, password, _ := strings.Cut(user, ":"); len(name) == 0 || len(password) == 0 {
+			errs.add("auth.basic."+strconv.Itoa(i), "expecting name:password")
+		}
+	}
+	for i, token := range c.Bearer {
+		if name, value, _ := strings.Cut(token, ":"); len(name) == 0 || len(value) == 0 {
+			errs.add("auth.bearer."+strconv.Itoa(i), "expecting name:token")
+		}
+	}
+	if len(c.ClientCA) > 0 {
+		if !tlsEnabled {
+			errs.add("auth.clientca", "client certificates require TLS")
+		}
+		if _, err := loadCertPool(c.ClientCA); err != nil {
+			errs.add("auth.clientca", "%v", err)
+		}
+	}
+}
+
+// configureClientAuth asks TLS clients for certificates verified by ClientCA, required if it's the only method.
+func (c AuthConfig) configureClientAuth(config *tls.Config) error {
+	if len(c.ClientCA) == 0 {
+		return nil
+	}
+	pool, err := loadCertPool(c.ClientCA)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if len(c.Basic) == 0 && len(c.Bearer) == 0 {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+func loadCertPool(fname string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", fname)
+	}
+	return pool, nil
+}
+
+func newAuthGate(config AuthConfig) *authGate {
+	if !config.enabled() {
+		return nil
+	}
+	result := &authGate{
+		basic:  make(map[string]string),
+		bearer: make(map[string]string),
+		mtls:   len(config.ClientCA) > 0,
+		header: http.CanonicalHeaderKey(config.Header),
+	}
+	if len(result.header) == 0 {
+		result.header = "Authorization"
+	}
+	for _, user := range config.Basic {
+		name, password, _ := strings.Cut(user, ":")
+		result.basic[name] = password
+	}
+	for _, token := range config.Bearer {
+		name, value, _ := strings.Cut(token, ":")
+		result.bearer[value] = name
+	}
+	return result
+}
+
+// authenticate returns the identity of r & the method it passed with, method is empty when it didn't.
+func (g *authGate) authenticate(r *http.Request) (identity string, method string) {
+	if g.mtls && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, authMTLS
+	}
+	scheme, credentials, _ := strings.Cut(r.Header.Get(g.header), " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && len(g.basic) > 0:
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return "", ""
+		}
+		name, password, _ := strings.Cut(string(decoded), ":")
+		expected, found := g.basic[name]
+		if found && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+			return name, authBasic
+		}
+	case strings.EqualFold(scheme, "Bearer"):
+		token := []byte(strings.TrimSpace(credentials))
+		for value, name := range g.bearer {
+			if subtle.ConstantTimeCompare(token, []byte(value)) == 1 {
+				return name, authBearer
+			}
+		}
+	}
+	return "", ""
+}
+
+// challenge answers 401, asking for basic auth if it's accepted.
+func (g *authGate) challenge(w http.ResponseWriter) {
+	if len(g.basic) > 0 && g.header == "Authorization" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hdproxy"`)
+	} else if len(g.bearer) > 0 && g.header == "Authorization" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hdproxy"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// authenticate checks r against the auth gate, answering it when rejected.
+// Gate credentials are removed from r, so they're neither forwarded nor dumped.
+func (p *Proxy) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if p.auth == nil {
+		return "", true
+	}
+	identity, method := p.auth.authenticate(r)
+	if len(method) == 0 {
+		p.logRejected(r, http.StatusUnauthorized, "unauthorized")
+		p.auth.challenge(w)
+		return "", false
+	}
+	if method != authMTLS {
+		// the header only carried gate credentials, with mTLS it's the client's own for target
+		r.Header.Del(p.auth.header)
+	}
+	return identity, true
+}
+
+// logUser is the user field of access log, "-" when unknown.
+func logUser(identity string) string {
+	if len(identity) == 0 {
+		return "-"
+	}
+	return strings.ReplaceAll(identity, " ", "_")
+}
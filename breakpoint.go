@@ -0,0 +1,313 @@
+package hdproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNotPaused is returned by Resume when there's no such exchange waiting, it may have timed out already.
+var errNotPaused = errors.New("exchange is not paused")
+
+// defaultBreakpointTimeout is used when ProxyConfig.BreakpointTimeout is not set.
+const defaultBreakpointTimeout = 5 * time.Minute
+
+// Sides an exchange can be paused at.
+const (
+	breakRequest  = "request"
+	breakResponse = "response"
+)
+
+type (
+	// BreakpointConfig pauses matching exchanges until resumed or aborted via admin API.
+	BreakpointConfig struct {
+		// Method to match, any method when empty.
+		Method string `json:"method,omitempty"`
+		// Path is a regex matched against the request URI, any when empty.
+		Path string `json:"path,omitempty"`
+		// Headers the request must have, values are regexes.
+		Headers map[string]string `json:"headers,omitempty"`
+		// Request pauses before forwarding, Response before answering the client, request only when neither is set.
+		Request  bool `json:"request,omitempty"`
+		Response bool `json:"response,omitempty"`
+	}
+
+	breakpoint struct {
+		method   string
+		path     *regexp.Regexp
+		headers  map[string]*regexp.Regexp
+		request  bool
+		response bool
+	}
+
+	// BreakpointAction resumes or aborts a paused exchange. Resuming at request side applies the ReplayEdits,
+	// at response side Status, Headers, DelHeaders & Body. Aborting answers the client with Status, default 502, & Body.
+	BreakpointAction struct {
+		ReplayEdits
+		Status int `json:"status,omitempty"`
+	}
+
+	// pausedExchange is an exchange waiting at a breakpoint, resp is nil at request side.
+	pausedExchange struct {
+		side   string
+		since  time.Time
+		req    *http.Request
+		body   []byte
+		resp   *http.Response
+		action chan pausedAction
+	}
+
+	pausedAction struct {
+		BreakpointAction
+		abort bool
+	}
+
+	// pausedExchanges are the exchanges waiting at breakpoints of a proxy, by id.
+	pausedExchanges struct {
+		mutex sync.Mutex
+		byID  map[int64]*pausedExchange
+	}
+
+	// adminPaused is the JSON representation of a paused exchange, redacted.
+	adminPaused struct {
+		ID      string      `json:"id"`
+		Side    string      `json:"side"`
+		Since   time.Time   `json:"since"`
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Status  int         `json:"status,omitempty"`
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}
+)
+
+func compileBreakpoints(configs []BreakpointConfig) ([]*breakpoint, ConfigErrors) {
+	var errs ConfigErrors
+	result := make([]*breakpoint, 0, len(configs))
+	for i, config := range configs {
+		key := "breakpoints." + strconv.Itoa(i)
+		b := &breakpoint{
+			method:   strings.ToUpper(strings.TrimSpace(config.Method)),
+			headers:  make(map[string]*regexp.Regexp),
+			request:  config.Request || !config.Response,
+			response: config.Response,
+		}
+		var err error
+		if b.path, err = regexp.Compile(config.Path); err != nil {
+			errs.add(key+".path", "invalid regex %q: %v", config.Path, err)
+		}
+		for name, pattern := range config.Headers {
+			if b.headers[http.CanonicalHeaderKey(name)], err = regexp.Compile(pattern); err != nil {
+				errs.add(key+".headers."+name, "invalid regex %q: %v", pattern, err)
+			}
+		}
+		result = append(result, b)
+	}
+	return result, errs
+}
+
+func (b *breakpoint) match(r *http.Request, side string) bool {
+	if side == breakRequest && !b.request || side == breakResponse && !b.response {
+		return false
+	}
+	if len(b.method) > 0 && b.method != r.Method || !b.path.MatchString(r.RequestURI) {
+		return false
+	}
+	for name, rx := range b.headers {
+		if !rx.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// breaks reports whether r has to pause at side, gRPC & WebSocket never do as they're streams.
+func (s *proxySettings) breaks(r *http.Request, side string) bool {
+	if isGRPC(r) {
+		return false
+	}
+	for _, b := range s.breakpoints {
+		if b.match(r, side) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) SetBreakpoints(configs []BreakpointConfig) error {
+	breakpoints, errs := compileBreakpoints(configs)
+	if len(errs) > 0 {
+		return errs
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.breakpoints = breakpoints
+		s.breakpointConfigs = append([]BreakpointConfig{}, configs...)
+	})
+	return nil
+}
+
+// pause parks ex at side until it's resumed, aborted, timed out (resumed unchanged) or the client is gone.
+// It returns false in the last case.
+func (p *Proxy) pause(ex *exchange, side string, req *http.Request, body []byte, resp *http.Response) (pausedAction, bool) {
+	paused := &pausedExchange{side: side, since: time.Now(), req: req, body: body, resp: resp, action: make(chan pausedAction, 1)}
+	p.paused.mutex.Lock()
+	p.paused.byID[ex.id] = paused
+	p.paused.mutex.Unlock()
+	defer func() {
+		p.paused.mutex.Lock()
+		delete(p.paused.byID, ex.id)
+		p.paused.mutex.Unlock()
+	}()
+
+	uri := p.redact.URI(req.RequestURI)
+	since := paused.since
+	p.logEvent(req, ex, fmt.Sprintf("\"BREAK %s %s %s\" paused", side, req.Method, uri))
+	timeout := p.config.BreakpointTimeout
+	if timeout == 0 {
+		timeout = defaultBreakpointTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case action := <-paused.action:
+		verb := "resumed"
+		if action.abort {
+			verb = "aborted"
+		}
+		p.logEvent(req, ex, fmt.Sprintf("\"BREAK %s %s %s\" %s after %v", side, req.Method, uri, verb, time.Since(since).Round(time.Millisecond)))
+		return action, true
+	case <-timer.C:
+		p.logEvent(req, ex, fmt.Sprintf("\"BREAK %s %s %s\" timed out after %v, resumed", side, req.Method, uri, timeout))
+		return pausedAction{}, true
+	case <-p.flights.drained():
+		p.logEvent(req, ex, fmt.Sprintf("\"BREAK %s %s %s\" resumed by shutdown", side, req.Method, uri))
+		return pausedAction{}, true
+	case <-req.Context().Done():
+		p.logEvent(req, ex, fmt.Sprintf("\"BREAK %s %s %s\" client gone after %v", side, req.Method, uri, time.Since(since).Round(time.Millisecond)))
+		return pausedAction{}, false
+	}
+}
+
+// breakRequest pauses r before it's forwarded, applying the edits it's resumed with.
+// It returns false when r is aborted or the client is gone, r is answered already in the first case.
+func (p *Proxy) breakRequest(w http.ResponseWriter, r *http.Request, ex *exchange) bool {
+	body, err := readBody(&r.Body)
+	if err != nil {
+		http.Error(w, "error reading request", bodyErrorStatus(err))
+		return false
+	}
+	action, ok := p.pause(ex, breakRequest, r, body, nil)
+	if !ok {
+		return false
+	}
+	if action.abort {
+		status := action.Status
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		p.logRejected(r, status, "aborted at breakpoint")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if action.Body != nil {
+			io.WriteString(w, *action.Body)
+		}
+		return false
+	}
+	settings, err := ex.settings.withTarget(action.Target)
+	if err != nil {
+		// checked by Resume already
+		settings = ex.settings
+	}
+	ex.settings = settings
+	action.ReplayEdits.apply(r, body)
+	return true
+}
+
+// breakResponse pauses resp before it's returned to client, editing it as it's resumed or aborted with.
+func (p *Proxy) breakResponse(ex *exchange, resp *http.Response) error {
+	body, err := readBody(&resp.Body)
+	if err != nil {
+		return err
+	}
+	action, ok := p.pause(ex, breakResponse, resp.Request, body, resp)
+	if !ok {
+		return fmt.Errorf("client gone at breakpoint")
+	}
+	if action.abort {
+		resp.StatusCode = http.StatusBadGateway
+		resp.Header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		body = nil
+	}
+	if action.Status != 0 {
+		resp.StatusCode = action.Status
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	for name, value := range action.Headers {
+		resp.Header.Set(name, value)
+	}
+	for _, name := range action.DelHeaders {
+		resp.Header.Del(name)
+	}
+	if action.Body != nil {
+		body = []byte(*action.Body)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	resp.TransferEncoding = nil
+	return nil
+}
+
+// Paused returns the exchanges waiting at breakpoints, oldest first, redacted.
+func (p *Proxy) Paused() []adminPaused {
+	p.paused.mutex.Lock()
+	result := make([]adminPaused, 0, len(p.paused.byID))
+	for id, paused := range p.paused.byID {
+		item := adminPaused{ID: strconv.FormatInt(id, 10), Side: paused.side, Since: paused.since, Method: paused.req.Method}
+		req, reqBody := p.redact.Request(paused.req, paused.body)
+		item.URL = req.RequestURI
+		// cloned as the exchange may resume & be edited while the result is encoded
+		item.Headers = req.Header.Clone()
+		item.Body = string(reqBody)
+		if paused.resp != nil {
+			resp, respBody := p.redact.Response(paused.resp, paused.body)
+			item.Status = resp.StatusCode
+			item.Headers = resp.Header.Clone()
+			item.Body = string(respBody)
+		}
+		result = append(result, item)
+	}
+	p.paused.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.Before(result[j].Since)
+	})
+	return result
+}
+
+// Resume continues the exchange paused with id, or aborts it.
+func (p *Proxy) Resume(id int64, action BreakpointAction, abort bool) error {
+	if len(action.Target) > 0 {
+		if _, err := parseTarget(action.Target); err != nil {
+			return err
+		}
+	}
+	p.paused.mutex.Lock()
+	paused, found := p.paused.byID[id]
+	if found {
+		delete(p.paused.byID, id)
+	}
+	p.paused.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("%w: %d", errNotPaused, id)
+	}
+	paused.action <- pausedAction{BreakpointAction: action, abort: abort}
+	return nil
+}
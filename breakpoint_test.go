@@ -0,0 +1,118 @@
+package hdproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakpoint_Match(t *testing.T) {
+	breakpoints, errs := compileBreakpoints([]BreakpointConfig{
+		{Method: "post", Path: "^/orders"},
+		{Path: "^/admin", Headers: map[string]string{"x-debug": "^1$"}, Response: true},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		method string
+		uri    string
+		debug  string
+		side   string
+		want   bool
+	}{
+		{"POST", "/orders/1", "", breakRequest, true},
+		{"POST", "/orders/1", "", breakResponse, false},
+		{"GET", "/orders/1", "", breakRequest, false},
+		{"GET", "/admin", "1", breakResponse, true},
+		{"GET", "/admin", "1", breakRequest, false},
+		{"GET", "/admin", "", breakResponse, false},
+	}
+	settings := &proxySettings{breakpoints: breakpoints}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.uri, nil)
+		if len(tt.debug) > 0 {
+			r.Header.Set("X-Debug", tt.debug)
+		}
+		if got := settings.breaks(r, tt.side); got != tt.want {
+			t.Errorf("breaks(%s %s debug=%q, %s) got %v, want %v", tt.method, tt.uri, tt.debug, tt.side, got, tt.want)
+		}
+	}
+	if _, errs = compileBreakpoints([]BreakpointConfig{{Path: "("}}); len(errs) != 1 || errs[0].Key != "breakpoints.0.path" {
+		t.Errorf("invalid path got %v", errs)
+	}
+}
+
+func TestProxy_BreakRequest(t *testing.T) {
+	p := &Proxy{
+		config:    ProxyConfig{BreakpointTimeout: 200 * time.Millisecond},
+		logWriter: io.Discard,
+		paused:    pausedExchanges{byID: make(map[int64]*pausedExchange)},
+	}
+	body := "edited"
+	tests := []struct {
+		name       string
+		action     *BreakpointAction
+		abort      bool
+		cancel     bool
+		want       bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"resume", &BreakpointAction{ReplayEdits: ReplayEdits{Body: &body}}, false, false, true, 0, "edited"},
+		{"abort", &BreakpointAction{Status: http.StatusTeapot, ReplayEdits: ReplayEdits{Body: &body}}, true, false, false, http.StatusTeapot, "edited"},
+		{"timeout", nil, false, false, true, 0, "original"},
+		{"client gone", nil, false, true, false, 0, ""},
+	}
+	for i, tt := range tests {
+		i, tt := i, tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("original")).WithContext(ctx)
+			ex := &exchange{id: int64(i + 1), settings: &proxySettings{}}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for len(p.Paused()) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				if tt.cancel {
+					cancel()
+				} else if tt.action != nil {
+					if err := p.Resume(ex.id, *tt.action, tt.abort); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			w := httptest.NewRecorder()
+			got := p.breakRequest(w, r, ex)
+			<-done
+			if got != tt.want {
+				t.Fatalf("breakRequest got %v, want %v", got, tt.want)
+			}
+			if tt.wantStatus != 0 && w.Code != tt.wantStatus {
+				t.Errorf("status got %d, want %d", w.Code, tt.wantStatus)
+			}
+			gotBody := w.Body.String()
+			if tt.want {
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			}
+			if gotBody != tt.wantBody {
+				t.Errorf("body got %q, want %q", gotBody, tt.wantBody)
+			}
+			if len(p.Paused()) != 0 {
+				t.Error("exchange still paused")
+			}
+		})
+	}
+	if err := p.Resume(42, BreakpointAction{}, false); !errors.Is(err, errNotPaused) {
+		t.Errorf("Resume unknown got %v, want errNotPaused", err)
+	}
+}
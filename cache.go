@@ -0,0 +1,469 @@
+package hdproxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+// defaultCacheEntries is used when CacheConfig.MaxEntries is not set.
+const defaultCacheEntries = 1000
+
+// defaultCacheMaxBody is used when CacheConfig.MaxBodySize is not set.
+const defaultCacheMaxBody = 1 << 20
+
+// Cache statuses shown in the access log & HAR cache comment.
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// cacheableStatus are the statuses cached by default, see RFC 9110 section 15.1.
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+type (
+	// CacheConfig caches GET & HEAD responses in memory, in front of the target.
+	CacheConfig struct {
+		// Enabled caches responses as allowed by their Cache-Control, Expires, ETag & Last-Modified,
+		// stale ones are revalidated with If-None-Match/If-Modified-Since.
+		Enabled bool
+		// MaxEntries kept, least recently used one is dropped first, default to 1000.
+		MaxEntries int
+		// MaxBodySize is the largest body cached in bytes, larger responses pass through, default to 1MiB.
+		MaxBodySize int64
+		// Force caches successful responses of matching paths whatever their headers say.
+		Force []CacheRule
+	}
+
+	CacheRule struct {
+		// Path is a regex matched against the request URI, like NoLog.
+		Path string
+		TTL  time.Duration
+	}
+
+	// responseCache is a RoundTripper serving GET & HEAD from cache, falling back to next.
+	responseCache struct {
+		next    http.RoundTripper
+		max     int
+		maxBody int64
+		force   []forceRule
+
+		mutex   sync.Mutex
+		entries map[string]*list.Element
+		lru     *list.List
+	}
+
+	forceRule struct {
+		path *regexp.Regexp
+		ttl  time.Duration
+	}
+
+	cacheEntry struct {
+		key        string
+		status     int
+		proto      string
+		protoMajor int
+		protoMinor int
+		header     http.Header
+		body       []byte
+		vary       map[string]string
+		stored     time.Time
+		expires    time.Time
+		lastAccess time.Time
+		hits       int
+		// revalidate on every use, from Cache-Control: no-cache
+		noCache bool
+	}
+
+	// cacheResult is what the cache did for an exchange.
+	cacheResult struct {
+		status string
+		before *harlog.CacheInfo
+		after  *harlog.CacheInfo
+	}
+)
+
+func (c CacheConfig) enabled() bool {
+	return c.Enabled || len(c.Force) > 0
+}
+
+func (c CacheConfig) validate(errs *ConfigErrors) {
+	if c.MaxEntries < 0 {
+		errs.add("cache.maxentries", "must not be negative")
+	}
+	if c.MaxBodySize < 0 {
+		errs.add("cache.maxbodysize", "must not be negative")
+	}
+	for i, rule := range c.Force {
+		key := "cache.force." + strconv.Itoa(i)
+		if _, err := regexp.Compile(rule.Path); err != nil {
+			errs.add(key+".path", "invalid regex %q: %v", rule.Path, err)
+		}
+		if rule.TTL <= 0 {
+			errs.add(key+".ttl", "must be positive")
+		}
+	}
+}
+
+// newResponseCache returns nil when caching is disabled.
+func newResponseCache(config CacheConfig, next http.RoundTripper) (*responseCache, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	result := &responseCache{
+		next:    next,
+		max:     config.MaxEntries,
+		maxBody: config.MaxBodySize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if result.max == 0 {
+		result.max = defaultCacheEntries
+	}
+	if result.maxBody == 0 {
+		result.maxBody = defaultCacheMaxBody
+	}
+	for _, rule := range config.Force {
+		rx, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		result.force = append(result.force, forceRule{path: rx, ttl: rule.TTL})
+	}
+	return result, nil
+}
+
+func (c *responseCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return c.next.RoundTrip(req)
+	}
+	ex := exchangeFrom(req.Context())
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") {
+		ex.cache = &cacheResult{status: cacheBypass}
+		return c.next.RoundTrip(req)
+	}
+	now := time.Now()
+	key := req.Method + " " + req.URL.String()
+	entry := c.get(key, req)
+	result := &cacheResult{status: cacheMiss}
+	ex.cache = result
+	if entry != nil {
+		result.before = entry.info()
+		if !reqCC.has("no-cache") && !entry.noCache && now.Before(entry.expires) {
+			entry = c.hit(entry, now)
+			result.status = cacheHit
+			result.after = entry.info()
+			return entry.response(req, now), nil
+		}
+	}
+
+	upstreamReq := req
+	conditional := entry != nil && len(req.Header.Get("If-None-Match")) == 0 && len(req.Header.Get("If-Modified-Since")) == 0
+	if conditional {
+		upstreamReq = req.Clone(req.Context())
+		if etag := entry.header.Get("ETag"); len(etag) > 0 {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.header.Get("Last-Modified"); len(lastModified) > 0 {
+			upstreamReq.Header.Set("If-Modified-Since", lastModified)
+		}
+		conditional = len(upstreamReq.Header.Get("If-None-Match")) > 0 || len(upstreamReq.Header.Get("If-Modified-Since")) > 0
+	}
+	resp, err := c.next.RoundTrip(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+	now = time.Now()
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry = c.revalidated(entry, resp.Header, c.rule(req), now)
+		result.status = cacheRevalidated
+		result.after = entry.info()
+		return entry.response(req, now), nil
+	}
+
+	if entry = newCacheEntry(key, req, resp, c.rule(req), now); entry == nil {
+		return resp, nil
+	}
+	body, err := readCacheBody(resp, c.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		entry.body = body
+		c.store(entry)
+		result.after = entry.info()
+	}
+	return resp, nil
+}
+
+// readCacheBody reads the body of resp when it's at most max bytes, nil otherwise.
+// resp.Body reads the whole body either way.
+func readCacheBody(resp *http.Response, max int64) ([]byte, error) {
+	if resp.ContentLength > max {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// rule returns the force rule matching req, or nil.
+func (c *responseCache) rule(req *http.Request) *forceRule {
+	uri := req.RequestURI
+	if len(uri) == 0 {
+		uri = req.URL.RequestURI()
+	}
+	for i := range c.force {
+		if c.force[i].path.MatchString(uri) {
+			return &c.force[i]
+		}
+	}
+	return nil
+}
+
+// get returns a copy of the entry of key, if the request headers listed in its Vary match.
+func (c *responseCache) get(key string, req *http.Request) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	for name, value := range entry.vary {
+		if req.Header.Get(name) != value {
+			return nil
+		}
+	}
+	result := *entry
+	return &result
+}
+
+func (c *responseCache) store(entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, found := c.entries[entry.key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// hit counts a use of entry, returning the updated copy.
+func (c *responseCache) hit(entry *cacheEntry, now time.Time) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, found := c.entries[entry.key]; found {
+		stored := elem.Value.(*cacheEntry)
+		stored.hits++
+		stored.lastAccess = now
+		c.lru.MoveToFront(elem)
+		result := *stored
+		return &result
+	}
+	return entry
+}
+
+// revalidated refreshes entry with the headers of 304 response, returning the updated copy.
+func (c *responseCache) revalidated(entry *cacheEntry, header http.Header, rule *forceRule, now time.Time) *cacheEntry {
+	updated := *entry
+	updated.header = entry.header.Clone()
+	for name, values := range header {
+		updated.header[name] = values
+	}
+	updated.expires, updated.noCache = freshness(updated.header, rule, now)
+	updated.stored = now
+	updated.lastAccess = now
+	updated.hits++
+	c.store(&updated)
+	return &updated
+}
+
+// Purge drops every entry, returning how many there were.
+func (c *responseCache) Purge() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return result
+}
+
+// newCacheEntry returns nil if resp is not to be cached, the body is left to the caller.
+func newCacheEntry(key string, req *http.Request, resp *http.Response, rule *forceRule, now time.Time) *cacheEntry {
+	if rule != nil {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil
+		}
+	} else {
+		cc := parseCacheControl(resp.Header)
+		if !cacheableStatus[resp.StatusCode] || cc.has("no-store") || cc.has("private") ||
+			len(resp.Header.Values("Set-Cookie")) > 0 || len(req.Header.Get("Authorization")) > 0 {
+			return nil
+		}
+	}
+	vary := make(map[string]string)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if len(name) > 0 {
+				vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+	result := &cacheEntry{
+		key:        key,
+		status:     resp.StatusCode,
+		proto:      resp.Proto,
+		protoMajor: resp.ProtoMajor,
+		protoMinor: resp.ProtoMinor,
+		header:     resp.Header.Clone(),
+		vary:       vary,
+		stored:     now,
+		lastAccess: now,
+	}
+	result.expires, result.noCache = freshness(resp.Header, rule, now)
+	if rule == nil && !now.Before(result.expires) && len(result.header.Get("ETag")) == 0 && len(result.header.Get("Last-Modified")) == 0 {
+		// already stale & can't be revalidated, useless
+		return nil
+	}
+	return result
+}
+
+// freshness returns until when a response with header is fresh, and whether it must be revalidated on every use.
+func freshness(header http.Header, rule *forceRule, now time.Time) (time.Time, bool) {
+	if rule != nil {
+		return now.Add(rule.ttl), false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return now, true
+	}
+	age, _ := strconv.Atoi(header.Get("Age"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, found := cc[directive]; found {
+			maxAge, err := strconv.Atoi(value)
+			if err != nil {
+				return now, false
+			}
+			return now.Add(time.Duration(maxAge-age) * time.Second), false
+		}
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return now, false
+		}
+		return now.Add(t.Sub(date)), false
+	}
+	// heuristic freshness, 10% of the time since last modified
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		return now.Add(date.Sub(lastModified) / 10), false
+	}
+	return now, false
+}
+
+// response builds the cached response to req, answering 304 to matching If-None-Match.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	status := e.status
+	body := e.body
+	if etag := header.Get("ETag"); len(etag) > 0 && req.Header.Get("If-None-Match") == etag {
+		status = http.StatusNotModified
+		body = nil
+	}
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         e.proto,
+		ProtoMajor:    e.protoMajor,
+		ProtoMinor:    e.protoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (e *cacheEntry) info() *harlog.CacheInfo {
+	return &harlog.CacheInfo{
+		Expires:    e.expires.Format(time.RFC3339),
+		LastAccess: e.lastAccess.Format(time.RFC3339),
+		ETag:       e.header.Get("ETag"),
+		HitCount:   e.hits,
+	}
+}
+
+// har returns the HAR cache object, empty one when the cache isn't involved.
+func (r *cacheResult) har() *harlog.Cache {
+	if r == nil {
+		return &harlog.Cache{}
+	}
+	return &harlog.Cache{BeforeRequest: r.before, AfterRequest: r.after, Comment: r.status}
+}
+
+// cacheControl are the directives of Cache-Control header, lowercase.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	result := make(cacheControl)
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if len(name) > 0 {
+				result[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return result
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, found := cc[directive]
+	return found
+}
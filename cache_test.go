@@ -0,0 +1,134 @@
+package hdproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		name        string
+		header      http.Header
+		rule        *forceRule
+		wantFresh   time.Duration
+		wantNoCache bool
+	}{
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, nil, time.Minute, false},
+		{"s-maxage first", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, nil, 2 * time.Minute, false},
+		{"minus age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, nil, 40 * time.Second, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, nil, 0, true},
+		{"expires", http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, nil, time.Hour, false},
+		{"invalid expires", http.Header{"Expires": {"0"}}, nil, 0, false},
+		{"heuristic", http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, nil, time.Hour, false},
+		{"nothing", http.Header{}, nil, 0, false},
+		{"forced", http.Header{"Cache-Control": {"no-store"}}, &forceRule{ttl: time.Minute}, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expires, noCache := freshness(tt.header, tt.rule, now)
+			if got := expires.Sub(now); got != tt.wantFresh {
+				t.Errorf("freshness = %v, want %v", got, tt.wantFresh)
+			}
+			if noCache != tt.wantNoCache {
+				t.Errorf("noCache = %v, want %v", noCache, tt.wantNoCache)
+			}
+		})
+	}
+}
+
+func TestResponseCache_RoundTrip(t *testing.T) {
+	var calls, notModified int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if strings.HasPrefix(r.URL.Path, "/large") {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		io.WriteString(w, "body of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	cache, err := newResponseCache(CacheConfig{MaxBodySize: 32, Force: []CacheRule{{Path: "^/forced", TTL: time.Minute}}}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, header http.Header) (*exchange, string) {
+		ex := &exchange{}
+		req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), exchangeKey{}, ex), http.MethodGet, upstream.URL+path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := cache.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s status = %d", path, resp.StatusCode)
+		}
+		return ex, string(body)
+	}
+	large := "/large/" + strings.Repeat("x", 32)
+	tests := []struct {
+		path       string
+		header     http.Header
+		wantStatus string
+		wantCalls  int
+		wantHits   int
+	}{
+		{"/fresh", nil, cacheMiss, 1, 0},
+		{"/fresh", nil, cacheHit, 1, 1},
+		{"/fresh", http.Header{"Cache-Control": {"no-store"}}, cacheBypass, 2, 0},
+		{"/fresh", http.Header{"Cache-Control": {"no-cache"}}, cacheMiss, 3, 0},
+		{"/etag", nil, cacheMiss, 4, 0},
+		{"/etag", nil, cacheRevalidated, 5, 1},
+		{"/private", nil, cacheMiss, 6, 0},
+		{"/private", nil, cacheMiss, 7, 0},
+		{"/forced", nil, cacheMiss, 8, 0},
+		{"/forced", nil, cacheHit, 8, 1},
+		{large, nil, cacheMiss, 9, 0},
+		{large, nil, cacheMiss, 10, 0},
+	}
+	for i, tt := range tests {
+		ex, body := get(tt.path, tt.header)
+		if body != "body of "+tt.path {
+			t.Errorf("%d %s body = %q", i, tt.path, body)
+		}
+		if ex.cache.status != tt.wantStatus {
+			t.Errorf("%d %s status = %s, want %s", i, tt.path, ex.cache.status, tt.wantStatus)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%d %s calls = %d, want %d", i, tt.path, calls, tt.wantCalls)
+		}
+		if tt.wantHits > 0 && (ex.cache.after == nil || ex.cache.after.HitCount != tt.wantHits) {
+			t.Errorf("%d %s after = %+v, want %d hits", i, tt.path, ex.cache.after, tt.wantHits)
+		}
+	}
+	if notModified != 1 {
+		t.Errorf("notModified = %d, want 1", notModified)
+	}
+	if purged := cache.Purge(); purged != 3 {
+		t.Errorf("purged = %d, want 3", purged)
+	}
+}
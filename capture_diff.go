@@ -0,0 +1,196 @@
+package hdproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+// ErrInvalidDiffConfig is wrapped by DiffCaptures errors about its config, e.g. invalid IgnoreJSON path.
+var ErrInvalidDiffConfig = errors.New("invalid diff config")
+
+type (
+	// CaptureDiffConfig is how DiffCaptures compares two captures.
+	CaptureDiffConfig struct {
+		DiffConfig
+		// IgnoreQuery are query parameters left out when pairing exchanges, e.g. _ts.
+		IgnoreQuery []string
+		// Latency also reports exchanges whose latency changed by at least this much, when set.
+		Latency time.Duration
+	}
+
+	// diffPair are the exchanges of both captures sharing the same key, either may be nil.
+	diffPair struct {
+		key  string
+		a, b *harlog.Entry
+	}
+)
+
+// ReadCapture reads the entries of a HAR file, or of a dump directory.
+func ReadCapture(path string) ([]*harlog.Entry, error) {
+	fInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fInfo.IsDir() {
+		dumps, err := ReadDumpDir(path)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]*harlog.Entry, len(dumps))
+		for i, d := range dumps {
+			result[i] = d.Entry()
+		}
+		return result, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harlog.HARContainer
+	if err = json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("invalid HAR: %w", err)
+	}
+	if har.Log == nil {
+		return nil, fmt.Errorf("invalid HAR: no log")
+	}
+	return har.Log.Entries, nil
+}
+
+// DiffCaptures pairs the exchanges of a & b by method, path & query (in any parameter order), the n-th
+// occurrence in a with the n-th in b, and writes their differences to w, reporting whether there's any.
+// Invalid config error wraps ErrInvalidDiffConfig.
+func DiffCaptures(w io.Writer, a, b []*harlog.Entry, config CaptureDiffConfig) (bool, error) {
+	d, err := newDiffer(config.DiffConfig)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidDiffConfig, err)
+	}
+	return diffCaptures(w, d, pairEntries(a, b, config.IgnoreQuery), config.Latency), nil
+}
+
+// pairKey is method, path & query sorted by name then value, leaving out ignored query parameters.
+func pairKey(e *harlog.Entry, ignoreQuery []string) string {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return e.Request.Method + " " + e.Request.URL
+	}
+	query := u.Query()
+	for _, name := range ignoreQuery {
+		query.Del(name)
+	}
+	key := e.Request.Method + " " + u.EscapedPath()
+	if len(query) == 0 {
+		return key
+	}
+	// Encode sorts by name, values of the same name are sorted here
+	for _, values := range query {
+		sort.Strings(values)
+	}
+	return key + "?" + query.Encode()
+}
+
+// pairEntries pairs the n-th occurrence of a key in a with the n-th in b, in order of first appearance.
+func pairEntries(a, b []*harlog.Entry, ignoreQuery []string) []*diffPair {
+	var result []*diffPair
+	pending := make(map[string][]*diffPair)
+	for _, e := range a {
+		key := pairKey(e, ignoreQuery)
+		pair := &diffPair{key: key, a: e}
+		pending[key] = append(pending[key], pair)
+		result = append(result, pair)
+	}
+	for _, e := range b {
+		key := pairKey(e, ignoreQuery)
+		if pairs := pending[key]; len(pairs) > 0 {
+			pairs[0].b = e
+			pending[key] = pairs[1:]
+			continue
+		}
+		result = append(result, &diffPair{key: key, b: e})
+	}
+	return result
+}
+
+// diffCaptures writes the differences of every pair to w, reporting whether there's any.
+func diffCaptures(w io.Writer, d *differ, pairs []*diffPair, latency time.Duration) bool {
+	var same, different, onlyA, onlyB int
+	var totalDelta time.Duration
+	for _, pair := range pairs {
+		switch {
+		case pair.b == nil:
+			onlyA++
+			fmt.Fprintf(w, "%s\n  only in a\n", pair.key)
+			continue
+		case pair.a == nil:
+			onlyB++
+			fmt.Fprintf(w, "%s\n  only in b\n", pair.key)
+			continue
+		}
+		diffs := d.Diff(entryDiffSide(pair.a), entryDiffSide(pair.b))
+		delta := time.Duration(pair.b.Time - pair.a.Time)
+		totalDelta += delta
+		slower := latency > 0 && (delta >= latency || -delta >= latency)
+		if len(diffs) == 0 {
+			same++
+		} else {
+			different++
+		}
+		if len(diffs) == 0 && !slower {
+			continue
+		}
+		fmt.Fprintln(w, pair.key)
+		for _, diff := range diffs {
+			fmt.Fprintln(w, "  "+diff)
+		}
+		fmt.Fprintf(w, "  time: %v -> %v (%s)\n", roundDuration(pair.a.Time), roundDuration(pair.b.Time), signedDuration(delta))
+	}
+	fmt.Fprintf(w, "%d same, %d different, %d only in a, %d only in b", same, different, onlyA, onlyB)
+	if paired := same + different; paired > 0 {
+		fmt.Fprintf(w, ", average latency %s", signedDuration(totalDelta/time.Duration(paired)))
+	}
+	fmt.Fprintln(w)
+	return different > 0 || onlyA > 0 || onlyB > 0
+}
+
+func roundDuration(d harlog.Duration) time.Duration {
+	return time.Duration(d).Round(time.Millisecond)
+}
+
+// signedDuration formats d in milliseconds with its sign, e.g. +120ms.
+func signedDuration(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
+
+// entryDiffSide is the response of e, binary body is decoded back from base64.
+func entryDiffSide(e *harlog.Entry) diffSide {
+	result := diffSide{Header: make(http.Header)}
+	if e.Response == nil {
+		return result
+	}
+	result.Status = e.Response.Status
+	for _, h := range e.Response.Headers {
+		result.Header.Add(h.Name, h.Value)
+	}
+	if c := e.Response.Content; c != nil {
+		result.Body = []byte(c.Text)
+		if c.Encoding == "base64" {
+			if body, err := base64.StdEncoding.DecodeString(c.Text); err == nil {
+				result.Body = body
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package hdproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+func diffEntry(method, url string, status int, body string, elapsed time.Duration) *harlog.Entry {
+	return &harlog.Entry{
+		Time:    harlog.Duration(elapsed),
+		Request: &harlog.Request{Method: method, URL: url},
+		Response: &harlog.Response{
+			Status:  status,
+			Headers: []*harlog.NVP{{Name: "Content-Type", Value: "application/json"}, {Name: "X-Request-Id", Value: url}},
+			Content: &harlog.Content{Text: body},
+		},
+	}
+}
+
+func TestPairKey(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://a/users", "GET /users"},
+		{"http://a/users?b=2&a=1", "GET /users?a=1&b=2"},
+		{"http://b/users?a=2&a=1&_ts=123", "GET /users?a=1&a=2"},
+		{"http://b/users?_ts=123", "GET /users"},
+	}
+	for _, tt := range tests {
+		if got := pairKey(diffEntry("GET", tt.url, 200, "", 0), []string{"_ts"}); got != tt.want {
+			t.Errorf("pairKey(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDiffCaptures(t *testing.T) {
+	a := []*harlog.Entry{
+		diffEntry("GET", "http://old/users?b=1&a=2", 200, `{"id":1,"ts":1}`, 10*time.Millisecond),
+		diffEntry("GET", "http://old/users/1", 200, `{"name":"a"}`, 10*time.Millisecond),
+		diffEntry("GET", "http://old/users/1", 200, `{"name":"a"}`, 10*time.Millisecond),
+		diffEntry("DELETE", "http://old/users/1", 204, ``, 10*time.Millisecond),
+	}
+	b := []*harlog.Entry{
+		diffEntry("GET", "http://new/users/1", 200, `{"name":"a"}`, 20*time.Millisecond),
+		diffEntry("GET", "http://new/users?a=2&b=1", 200, `{"id":1,"ts":2}`, 30*time.Millisecond),
+		diffEntry("GET", "http://new/users/1", 500, `{"name":"b"}`, 250*time.Millisecond),
+		diffEntry("POST", "http://new/users", 201, ``, 10*time.Millisecond),
+	}
+	d, err := newDiffer(DiffConfig{IgnoreHeaders: []string{"X-Request-Id"}, IgnoreJSON: []string{"ts"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !diffCaptures(&out, d, pairEntries(a, b, nil), 200*time.Millisecond) {
+		t.Error("diffCaptures reported no difference")
+	}
+	want := []string{
+		"GET /users/1",
+		"  status: 200 != 500",
+		`  body name: "a" != "b"`,
+		"  time: 10ms -> 250ms (+240ms)",
+		"DELETE /users/1",
+		"  only in a",
+		"POST /users",
+		"  only in b",
+		"2 same, 1 different, 1 only in a, 1 only in b, average latency +90ms",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diffCaptures got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	out.Reset()
+	if diffCaptures(&out, d, pairEntries(a[:1], b[1:2], nil), 0) {
+		t.Errorf("diffCaptures reported difference: %s", out.String())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/siroj100/hdproxy"
+)
+
+const configCheckUsage = `usage: hdproxy config check [flags]
+
+Validates config from file, environment & flags the same way hdproxy does on start,
+reporting every problem found. Exit code is non-zero when config is invalid.
+
+`
+
+func runConfig(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprint(os.Stderr, configCheckUsage)
+		return 2
+	}
+	var (
+		options hdproxy.ConfigOptions
+		print   bool
+	)
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	registerConfigFlags(flags, &options)
+	flags.BoolVar(&print, "print", false, "print the effective config")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), configCheckUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	config, err := options.Load()
+	if err != nil {
+		printConfigErrors(os.Stderr, err)
+		return 1
+	}
+	if print {
+		hdproxy.PrintConfig(os.Stdout, config)
+	}
+	fmt.Fprintln(os.Stderr, "config OK,", len(config.Proxies), "proxies")
+	return 0
+}
+
+func printConfigErrors(w io.Writer, err error) {
+	var errs hdproxy.ConfigErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintln(w, "invalid config:", err)
+		return
+	}
+	fmt.Fprintf(w, "invalid config, %d error(s):\n", len(errs))
+	for _, err := range errs {
+		fmt.Fprintln(w, " ", err)
+	}
+}
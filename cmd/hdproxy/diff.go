@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/siroj100/hdproxy"
+)
+
+const diffUsage = `usage: hdproxy diff [flags] <capture a> <capture b>
+
+Compares two captures, each either a HAR file or a log/<port> dump directory.
+Exchanges are paired by method, path & query (in any parameter order), the n-th
+occurrence in a with the n-th in b. Status, headers & body are compared, JSON body
+path by path, along with the latency. Exit code is 1 when they differ.
+
+`
+
+func runDiff(args []string) int {
+	var (
+		ignoreHeaders stringsFlag
+		ignoreJSON    stringsFlag
+		ignoreQuery   stringsFlag
+		latency       time.Duration
+	)
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.Var(&ignoreHeaders, "ignore-header", "response header left out of the comparison, e.g. X-Request-Id, can be repeated")
+	flags.Var(&ignoreJSON, "ignore-json", "JSON body path left out of the comparison, e.g. meta.timestamp or items.*.id, can be repeated")
+	flags.Var(&ignoreQuery, "ignore-query", "query parameter left out when pairing exchanges, e.g. _ts, can be repeated")
+	flags.DurationVar(&latency, "latency", 0, "also report exchanges whose latency changed by at least this much, e.g. 100ms")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), diffUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	a, err := hdproxy.ReadCapture(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading", flags.Arg(0), ":", err)
+		return 2
+	}
+	b, err := hdproxy.ReadCapture(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading", flags.Arg(1), ":", err)
+		return 2
+	}
+	config := hdproxy.CaptureDiffConfig{
+		DiffConfig:  hdproxy.DiffConfig{IgnoreHeaders: ignoreHeaders, IgnoreJSON: ignoreJSON},
+		IgnoreQuery: ignoreQuery,
+		Latency:     latency,
+	}
+	different, err := hdproxy.DiffCaptures(os.Stdout, a, b, config)
+	if errors.Is(err, hdproxy.ErrInvalidDiffConfig) {
+		fmt.Fprintln(os.Stderr, "invalid -ignore-json:", err)
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "diff:", err)
+		return 2
+	}
+	if different {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/siroj100/hdproxy"
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+const exportUsage = `usage: hdproxy export [flags] <dump dir>...
+
+Converts log/<port> dump directories into a single HAR 1.2 file.
+
+`
+
+// exportTimeLayouts are accepted for -from & -to, all in local time zone except RFC3339.
+var exportTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func runExport(args []string) int {
+	var (
+		output  string
+		fromStr string
+		toStr   string
+		path    string
+	)
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&output, "o", "", "HAR file to write, default to stdout")
+	flags.StringVar(&fromStr, "from", "", "only export requests started at or after this time, e.g. \"2006-01-02 15:04:05\"")
+	flags.StringVar(&toStr, "to", "", "only export requests started before this time")
+	flags.StringVar(&path, "path", "", "only export requests whose URI matches this regex")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), exportUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	from, err := parseExportTime(fromStr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -from:", err)
+		return 2
+	}
+	to, err := parseExportTime(toStr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -to:", err)
+		return 2
+	}
+	var pathRx *regexp.Regexp
+	if len(path) > 0 {
+		if pathRx, err = regexp.Compile(path); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -path:", err)
+			return 2
+		}
+	}
+
+	entries := make([]*harlog.Entry, 0)
+	for _, dir := range flags.Args() {
+		dumps, err := hdproxy.ReadDumpDir(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading", dir, ":", err)
+			return 1
+		}
+		for _, d := range dumps {
+			if !from.IsZero() && d.Start.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !d.Start.Before(to) {
+				continue
+			}
+			if pathRx != nil && !pathRx.MatchString(d.Request.RequestURI) {
+				continue
+			}
+			entries = append(entries, d.Entry())
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if len(output) > 0 {
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error creating", output, ":", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(hdproxy.HAR(entries)); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing HAR:", err)
+		return 1
+	}
+	if len(output) > 0 {
+		fmt.Fprintln(os.Stderr, "exported", len(entries), "entries to", output)
+	}
+	return 0
+}
+
+func parseExportTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range exportTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", s)
+}
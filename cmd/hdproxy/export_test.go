@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siroj100/hdproxy"
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+func TestRunExport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	p, err := hdproxy.New(hdproxy.WithConfig(hdproxy.ProxyConfig{Port: 8080}), hdproxy.WithTarget(upstream.URL), hdproxy.WithLogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/orders", "/health"} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"x":1}`)))
+	}
+
+	output := filepath.Join(dir, "out.har")
+	if code := runExport([]string{"-o", output, "-path", "^/orders", filepath.Join(dir, "8080")}); code != 0 {
+		t.Fatalf("runExport() = %d, want 0", code)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harlog.HARContainer
+	if err = json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid HAR: %v\n%s", err, data)
+	}
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("HAR got %d entries, want 1:\n%s", len(har.Log.Entries), data)
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != http.MethodPost || !strings.HasSuffix(e.Request.URL, "/orders") || e.Response.Status != http.StatusCreated {
+		t.Errorf("HAR entry got %s %s %d, want POST .../orders 201", e.Request.Method, e.Request.URL, e.Response.Status)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != `{"x":1}` || e.Response.Content.Text != `{"id":1}` {
+		t.Errorf("HAR entry bodies got %+v, %+v", e.Request.PostData, e.Response.Content)
+	}
+
+	if code := runExport([]string{"-from", "yesterday", dir}); code != 2 {
+		t.Errorf("runExport() with invalid -from = %d, want 2", code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/siroj100/hdproxy"
+)
+
+type (
+	// stringsFlag is a flag that can be repeated, each value is also split by comma.
+	stringsFlag []string
+
+	// mappingFlags collects repeated -map flags.
+	mappingFlags []hdproxy.ProxyMapping
+)
+
+func (s *stringsFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
+
+func (m *mappingFlags) String() string {
+	if m == nil {
+		return ""
+	}
+	result := make([]string, len(*m))
+	for i, mapping := range *m {
+		result[i] = mapping.String()
+	}
+	return strings.Join(result, " ")
+}
+
+func (m *mappingFlags) Set(s string) error {
+	mapping, err := hdproxy.ParseMapping(s)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, mapping)
+	return nil
+}
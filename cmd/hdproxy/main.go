@@ -0,0 +1,173 @@
+// Command hdproxy is a logging reverse proxy, see hdproxy.toml.sample for its config.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/siroj100/hdproxy"
+)
+
+const configUsage = `usage: hdproxy [flags]
+       hdproxy <command> [flags] [args]
+
+Commands:
+  export          convert dump directories to HAR
+  config check    validate config, -print to also print the effective config
+  diff            compare two captures, HAR files or dump directories
+  snippet         print captured requests as curl, HTTPie or .http
+  replay          send a captured request again through a running proxy, optionally edited
+
+Proxies are configured from these sources, later one overrides earlier per field:
+  1. config file, -config or hdproxy.{toml,yaml,yml,json} in current folder.
+     The default file is skipped when -map or -port is given, and optional when
+     there are proxies configured from environment.
+     Proxies are [proxies.<name>] sections with Port, or legacy [<port>] sections,
+     both inherit [defaults]. include = ["conf.d/*.toml"] merges more files,
+     relative to the including file.
+  2. environment variables HDPROXY_<PORT>_<KEY>, e.g.
+     HDPROXY_8080_TARGET=https://a HDPROXY_8080_HOLD=2s HDPROXY_8080_NOLOG=^/health,^/metrics
+  3. -map flags, e.g. -map 8080=https://a,hold=2s,nolog=^/health -map 8081=https://b
+  4. -port, -target & -hold flags for a single proxy.
+
+Flags:
+`
+
+// commands are the subcommands, called with the rest of the arguments and returning exit code.
+var commands = map[string]func(args []string) int{
+	"export":  runExport,
+	"config":  runConfig,
+	"diff":    runDiff,
+	"snippet": runSnippet,
+	"replay":  runReplay,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the hdproxy command with args, the command line without program name, returning the exit code.
+// Proxies run until SIGINT or SIGTERM.
+func run(args []string) int {
+	if len(args) > 0 {
+		if cmd, found := commands[args[0]]; found {
+			return cmd(args[1:])
+		}
+	}
+	proxies := hdproxy.NewProxies()
+	config, exitCode, ok := initConfig(args)
+	if !ok {
+		return exitCode
+	}
+	proxyConfs := config.Proxies
+	//fmt.Printf("proxyConfs: %+v\n", proxyConfs)
+	for _, conf := range proxyConfs {
+		proxy, err := hdproxy.NewProxy(conf)
+		if err != nil {
+			log.Println("Port", conf.Port, ":", err)
+			return 1
+		}
+		if err = proxy.Listen(); err != nil {
+			log.Println("Port", conf.Port, ":", err)
+			return 1
+		}
+		go func() {
+			if err := proxy.Serve(); err != nil && err != http.ErrServerClosed {
+				log.Fatalln("Port", proxy.Port(), ":", err)
+			}
+		}()
+		// port picked for port 0 is known once listening
+		fmt.Println(proxy.Port(), "->", conf.Target, "hold:", conf.Hold, "listen:", proxy.Addr())
+		proxies.Add(proxy)
+
+	}
+
+	var admin *hdproxy.AdminServer
+	if len(config.Admin.Addr) > 0 {
+		var err error
+		if admin, err = hdproxy.NewAdminServer(config.Admin, proxies); err != nil {
+			log.Println("Admin", config.Admin.Addr, ":", err)
+			return 1
+		}
+		admin.DrainTimeout = config.DrainTimeout
+		if len(config.Admin.Token) == 0 {
+			fmt.Println("admin token:", admin.Token())
+		}
+		go func() {
+			if err := admin.Start(); err != nil && err != http.ErrServerClosed {
+				log.Fatalln("Admin", config.Admin.Addr, ":", err)
+			}
+		}()
+		fmt.Println("admin API:", config.Admin.Addr)
+	}
+
+	c := make(chan os.Signal, 1)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM (docker stop).
+	// SIGKILL or SIGQUIT (Ctrl+/) will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	// Block until we receive our signal.
+	<-c
+
+	fmt.Println("shutting down, draining for up to", config.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	proxies.Shutdown(ctx)
+	return 0
+}
+
+// initConfig parses the command line of the proxies, args without program name, & loads their config.
+// ok is false with the exit code when there's nothing to run, e.g. invalid config or -dry-run.
+func initConfig(args []string) (config hdproxy.Config, exitCode int, ok bool) {
+	var (
+		options hdproxy.ConfigOptions
+		dryRun  bool
+		drain   time.Duration
+	)
+	flags := flag.NewFlagSet("hdproxy", flag.ContinueOnError)
+	registerConfigFlags(flags, &options)
+	flags.BoolVar(&dryRun, "dry-run", false, "validate & print the effective config, then exit")
+	flags.DurationVar(&drain, "drain-timeout", hdproxy.DefaultDrainTimeout, "how long shutdown waits for requests & WebSockets in flight, keep it below docker stop's timeout")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), configUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return config, 0, false
+	} else if err != nil {
+		return config, 2, false
+	}
+	config, err := options.Load()
+	if err != nil {
+		printConfigErrors(os.Stderr, err)
+		return config, 1, false
+	}
+	if dryRun {
+		hdproxy.PrintConfig(os.Stdout, config)
+		return config, 0, false
+	}
+	config.DrainTimeout = drain
+	return config, 0, true
+}
+
+// registerConfigFlags adds the flags affecting config to flags, shared by every command reading config.
+func registerConfigFlags(flags *flag.FlagSet, o *hdproxy.ConfigOptions) {
+	flags.StringVar(&o.File, "config", "", "config file to read")
+	flags.Var((*mappingFlags)(&o.Mappings), "map", "proxy mapping port=target[,hold=duration][,listen=address][,nolog=regex]..., can be repeated")
+	flags.IntVar(&o.Port, "port", 0, "local port to listen to")
+	flags.StringVar(&o.Target, "target", "", "target URL to proxy to")
+	flags.DurationVar(&o.Hold, "hold", 0, "how long to hold the request")
+	flags.StringVar(&o.Admin.Addr, "admin", os.Getenv("HDPROXY_ADMIN_ADDR"), "address for admin API to listen to, e.g. 127.0.0.1:9090, default to $HDPROXY_ADMIN_ADDR")
+	flags.StringVar(&o.Admin.Token, "admin-token", os.Getenv("HDPROXY_ADMIN_TOKEN"), "admin API token, default to $HDPROXY_ADMIN_TOKEN or random one")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/siroj100/hdproxy"
+)
+
+// adminError is the body of admin API errors.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+const replayUsage = `usage: hdproxy replay [flags] <exchange id>
+
+Sends a captured request again through a running proxy via its admin API, optionally
+edited. The new exchange is logged as usual, linked to the original one by its HAR comment.
+
+`
+
+func runReplay(args []string) int {
+	var (
+		addr    string
+		token   string
+		port    int
+		body    string
+		headers stringsFlag
+		query   stringsFlag
+		edits   hdproxy.ReplayEdits
+	)
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.StringVar(&addr, "admin", os.Getenv("HDPROXY_ADMIN_ADDR"), "admin API address, default to $HDPROXY_ADMIN_ADDR")
+	flags.StringVar(&token, "admin-token", os.Getenv("HDPROXY_ADMIN_TOKEN"), "admin API token, default to $HDPROXY_ADMIN_TOKEN")
+	flags.IntVar(&port, "port", 0, "proxy port the exchange was captured on")
+	flags.StringVar(&edits.Target, "target", "", "send to this target instead of the proxy's")
+	flags.StringVar(&edits.Method, "method", "", "replace the method")
+	flags.Var(&headers, "H", "set header \"Name: value\", can be repeated")
+	flags.Var((*stringsFlag)(&edits.DelHeaders), "del-header", "remove header, can be repeated")
+	flags.Var(&query, "query", "set query parameter name=value, can be repeated")
+	flags.Var((*stringsFlag)(&edits.DelQuery), "del-query", "remove query parameter, can be repeated")
+	flags.StringVar(&body, "body", "", "replace the body, @file to read it from file")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), replayUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || port == 0 || len(addr) == 0 {
+		flags.Usage()
+		return 2
+	}
+	id := flags.Arg(0)
+	if len(headers) > 0 {
+		edits.Headers = make(map[string]string)
+		for _, h := range headers {
+			name, value, found := strings.Cut(h, ":")
+			if !found {
+				fmt.Fprintf(os.Stderr, "invalid header %q, expecting \"Name: value\"\n", h)
+				return 2
+			}
+			edits.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	if len(query) > 0 {
+		edits.Query = make(map[string]string)
+		for _, q := range query {
+			name, value, _ := strings.Cut(q, "=")
+			edits.Query[name] = value
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "body" {
+			edits.Body = &body
+		}
+	})
+	if edits.Body != nil && strings.HasPrefix(body, "@") {
+		data, err := os.ReadFile(body[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading body:", err)
+			return 2
+		}
+		body = string(data)
+	}
+
+	data, _ := json.Marshal(edits)
+	u := url.URL{Scheme: "http", Host: addr, Path: fmt.Sprintf("/proxies/%d/exchanges/%s/replay", port, url.PathEscape(id))}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error calling admin API:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var adminErr adminError
+		if json.Unmarshal(respBody, &adminErr) == nil && len(adminErr.Error) > 0 {
+			fmt.Fprintln(os.Stderr, "replay failed:", adminErr.Error)
+		} else {
+			fmt.Fprintln(os.Stderr, "replay failed:", resp.Status)
+		}
+		return 1
+	}
+	var result hdproxy.ReplayResult
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid admin API response:", err)
+		return 1
+	}
+	fmt.Println("replayed", result.ReplayOf, "as", result.ID, "status", result.Status)
+	return 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/siroj100/hdproxy"
+)
+
+const snippetUsage = `usage: hdproxy snippet [flags] <dump id or file>...
+
+Prints captured requests as runnable curl or HTTPie commands, or .http file entries,
+sent to the URL the proxy forwarded them to. Dump files are already redacted as
+configured when captured, the -redact flags hide more.
+
+`
+
+func runSnippet(args []string) int {
+	var (
+		format string
+		dir    string
+		port   int
+		redact hdproxy.RedactConfig
+	)
+	flags := flag.NewFlagSet("snippet", flag.ContinueOnError)
+	flags.StringVar(&format, "format", hdproxy.SnippetCurl, "curl, httpie or http")
+	flags.IntVar(&port, "port", 0, "proxy port whose log/<port> dumps the ids refer to")
+	flags.StringVar(&dir, "dir", "", "dump directory the ids refer to, instead of -port")
+	flags.Var((*stringsFlag)(&redact.Headers), "redact-header", "header to redact, can be repeated")
+	flags.Var((*stringsFlag)(&redact.Query), "redact-query", "query & form parameter to redact, can be repeated")
+	flags.Var((*stringsFlag)(&redact.JSON), "redact-json", "JSON body path to redact, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), snippetUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	if len(dir) == 0 && port != 0 {
+		dir = fmt.Sprintf("log/%d", port)
+	}
+	redactor, err := hdproxy.NewRedactor(redact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for i, arg := range flags.Args() {
+		var d *hdproxy.Dump
+		if id, perr := strconv.ParseInt(arg, 10, 64); perr == nil {
+			if len(dir) == 0 {
+				fmt.Fprintln(os.Stderr, "-port or -dir is required for dump id", arg)
+				return 2
+			}
+			d, err = hdproxy.ReadDump(dir, id)
+		} else {
+			d, err = hdproxy.ReadDumpFile(arg)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading", arg, ":", err)
+			return 1
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		if err = hdproxy.FormatSnippet(os.Stdout, format, d, redactor); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	return 0
+}
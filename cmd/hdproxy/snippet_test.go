@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSnippetMissingDump(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"id", []string{"-dir", dir, "12345"}},
+		{"file", []string{filepath.Join(dir, "nonexist-req")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := runSnippet(tt.args); code != 1 {
+				t.Errorf("runSnippet(%q) = %d, want 1", tt.args, code)
+			}
+		})
+	}
+}
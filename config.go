@@ -1,90 +1,327 @@
-package main
+package hdproxy
 
 import (
-	"flag"
+	"errors"
+	"fmt"
 	"io"
-	"log"
-	"net/url"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/spf13/viper"
 )
 
+// envProxyKey matches environment variables configuring a proxy, e.g. HDPROXY_8080_TARGET.
+var envProxyKey = regexp.MustCompile(`^HDPROXY_(\d+)_(\w+)$`)
+
+// mappingOption matches the comma starting the next option of a mapping, so values can have commas, e.g. nolog=^/a{1,3}.
+var mappingOption = regexp.MustCompile(`,\s*[a-zA-Z]+=`)
+
 type (
+	Config struct {
+		Proxies []ProxyConfig
+		Admin   AdminConfig
+		// DrainTimeout is how long shutdown waits for requests & WebSockets in flight, from -drain-timeout flag.
+		DrainTimeout time.Duration
+	}
+
 	ProxyConfig struct {
-		Port   int
+		// Name of [proxies.<name>] section, empty for legacy [<port>] section.
+		Name string
+		// Port identifies the proxy & its log folder, also the port to listen to unless Listen is a unix socket.
+		// 0 picks a free port, the actual address is printed on start & shown by admin API.
+		// Unix socket proxies keep theirs, so each needs a distinct one, 0 included.
+		Port int
+		// Listen is the address to bind: empty for every interface, an IP like 127.0.0.1 or [::1],
+		// a network interface name like lo, or unix:<path> for Unix domain socket.
+		Listen string
+		// SocketMode is the permission of the unix socket, e.g. "0660".
+		SocketMode os.FileMode
+		// TLS makes the listener serve HTTPS.
+		TLS TLSConfig
+		// H2C accepts cleartext HTTP/2, both prior knowledge & upgrade from HTTP/1.1.
+		H2C bool
+		// H2 offers HTTP/2 on TLS listener.
+		H2 bool
+		// UpstreamProtocol is "http1" or "http2" to force the protocol to upstream, negotiated when empty.
+		UpstreamProtocol string
+		// GRPC descriptors to decode gRPC messages into JSON in the dump files.
+		GRPC GRPCConfig
+		// Mocks are endpoints answered by the proxy itself, first match wins.
+		Mocks []MockConfig
+		// Mirror sends a copy of requests to a shadow target, diffs are written to log/<port>/<id>-mirror.
+		Mirror MirrorConfig
+		// Cache answers GET & HEAD from memory when allowed, hits & misses are shown in the access log.
+		Cache CacheConfig
+		// Access allows or denies clients by IP, denied requests get 403 & are logged as DENIED.
+		Access AccessConfig
+		// Auth requires clients to authenticate, the identity is the user field of the access log.
+		Auth AuthConfig
+		// RateLimits answer 429 to requests over any of them, Concurrency caps requests in flight.
+		RateLimits  []RateLimitConfig
+		Concurrency ConcurrencyConfig
+		// Breakpoints pause matching exchanges until resumed or aborted via admin API, or BreakpointTimeout
+		// passes (default to 5m) & they continue unchanged.
+		Breakpoints       []BreakpointConfig
+		BreakpointTimeout time.Duration
+		// Timeouts of client & upstream connections, none or Go's defaults when not set.
+		Timeouts TimeoutsConfig
+		// Gate holds matching requests until released via admin API, Hold applies once released.
+		Gate   GateConfig
 		Target string
 		Hold   time.Duration
 		NoLog  []string
+		// Redact rules applied to dump files, access log & HAR.
+		Redact RedactConfig
+		// HarSize is how many latest exchanges are kept as HAR, written to log/<port>.har on shutdown.
+		// Default to 1000, negative value to disable.
+		HarSize int
+	}
+
+	// ConfigOptions are the sources of config besides config file & environment, e.g. command line flags.
+	ConfigOptions struct {
+		// File is the config file, hdproxy.{toml,yaml,yml,json} in current folder when empty,
+		// optional then when there are proxies configured from environment.
+		File string
+		// Port, Target & Hold configure a single proxy, when both Port & Target are set.
+		Port   int
+		Target string
+		Hold   time.Duration
+		// Mappings configure proxies like -map flags, see ParseMapping.
+		Mappings []ProxyMapping
+		// Admin overrides the admin API address & token, when set.
+		Admin AdminConfig
+	}
+
+	// ProxyMapping is a proxy given from command line, nil fields are left as configured elsewhere.
+	ProxyMapping struct {
+		port    int
+		target  string
+		hold    *time.Duration
+		listen  *string
+		noLog   []string
+		harSize *int
 	}
 )
 
-func InitConfig() []ProxyConfig {
-	var (
-		fname  string
-		port   int
-		target string
-		hold   time.Duration
-	)
-
-	flag.StringVar(&fname, "config", "", "config file to read")
-	flag.IntVar(&port, "port", 0, "local port to listen to")
-	flag.StringVar(&target, "target", "", "target URL to proxy to")
-	flag.DurationVar(&hold, "hold", 0, "how long to hold the request")
-	flag.Parse()
-	target = strings.TrimSpace(target)
-	if port != 0 && len(target) > 0 {
-		_, err := url.Parse(target)
-		if err != nil {
-			log.Fatalln("invalid target url")
+// Load reads & validates the config from every source, error is ConfigErrors listing every problem found.
+func (o ConfigOptions) Load() (Config, error) {
+	l := newConfigLoader()
+	mappings := o.Mappings
+	target := strings.TrimSpace(o.Target)
+	if o.Port != 0 && len(target) > 0 {
+		if _, err := parseTarget(target); err != nil {
+			l.errs = append(l.errs, &ConfigError{Source: "-target", Err: err})
+		}
+		hold := o.Hold
+		mappings = append(mappings, ProxyMapping{port: o.Port, target: target, hold: &hold})
+	}
+
+	fname := strings.TrimSpace(o.File)
+	if len(fname) > 0 || len(mappings) == 0 {
+		optional := len(fname) == 0
+		if optional {
+			fname = defaultConfigFiles[0]
+			for _, fn := range defaultConfigFiles {
+				if _, err := os.Stat(fn); err == nil {
+					fname = fn
+					break
+				}
+			}
 		}
-		result := make([]ProxyConfig, 1)
-		result[0] = ProxyConfig{
-			Port:   port,
-			Target: target,
-			Hold:   hold,
+		err := l.readFile(fname)
+		if os.IsNotExist(err) && optional && hasEnvProxies() {
+			err = nil
+		}
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			return Config{}, append(l.errs, errs...)
+		} else if err != nil {
+			l.errs = append(l.errs, &ConfigError{Source: fname, Err: fmt.Errorf("no port or target provided, and failed to read config file: %w", err)})
+			return Config{}, l.errs
 		}
-		return result
 	}
-	fname = strings.TrimSpace(fname)
-	if len(fname) < 1 {
-		fname = "hdproxy.toml"
+	bindEnvProxies(l.v)
+	configs := l.proxies()
+	for _, m := range mappings {
+		key := l.portKey(m.port)
+		if m.port == 0 {
+			// port 0 picks any free port, so every such mapping is a proxy of its own
+			key = anyPortKey(configs)
+		}
+		cfg := configs[key]
+		m.apply(&cfg)
+		configs[key] = cfg
+		l.setMappingSources(key, m)
 	}
-	fstream, err := os.Open(fname)
-	if err != nil {
-		log.Fatalln("no port or target provided, and failed to read config file,", err)
+	result := l.validateAll(configs)
+	if len(result) == 0 && len(l.errs) == 0 {
+		l.errs = append(l.errs, &ConfigError{Source: l.fname, Err: errors.New("no proxy configured")})
 	}
-	result := ReadConfig(fstream)
 	//fmt.Printf("%+v\n", result)
-	return result
+	if len(l.errs) > 0 {
+		return Config{}, l.errs
+	}
+	admin := l.admin
+	if len(o.Admin.Addr) > 0 {
+		admin.Addr = o.Admin.Addr
+	}
+	if len(o.Admin.Token) > 0 {
+		admin.Token = o.Admin.Token
+	}
+	return Config{Proxies: result, Admin: admin}, nil
 }
 
-func ReadConfig(stream io.Reader) []ProxyConfig {
-	var configs map[int]ProxyConfig
-	viper.SetConfigType("toml")
-	err := viper.ReadConfig(stream)
+// ReadConfig reads & validates proxies from TOML config stream.
+func ReadConfig(stream io.Reader) ([]ProxyConfig, error) {
+	l := newConfigLoader()
+	data, err := io.ReadAll(stream)
 	if err != nil {
-		log.Fatalln("can't read config", err)
+		return nil, err
 	}
-	err = viper.Unmarshal(&configs)
-	if err != nil {
-		log.Fatalln("can't parse config", err)
+	if err = l.read("", "toml", data, 0); err != nil {
+		return nil, err
+	}
+	result := l.validateAll(l.proxies())
+	if len(l.errs) > 0 {
+		return nil, l.errs
+	}
+	return result, nil
+}
+
+// validateAll validates every proxy of configs, by key, and returns them sorted.
+func (l *configLoader) validateAll(configs map[string]ProxyConfig) []ProxyConfig {
+	keys := sortedProxyKeys(configs)
+	result := make([]ProxyConfig, len(keys))
+	// unix socket proxies keep their port, which names their log files & identifies them at runtime
+	unixPorts := make(map[int]string)
+	for i, k := range keys {
+		l.validate(k, configs[k])
+		result[i] = configs[k]
+		if !strings.HasPrefix(strings.TrimSpace(configs[k].Listen), unixPrefix) {
+			continue
+		}
+		if first, found := unixPorts[configs[k].Port]; found {
+			var errs ConfigErrors
+			errs.add(k+".port", "port %d already used by unix socket proxy [%s], set a distinct port to tell them apart", configs[k].Port, first)
+			l.addErrors(errs)
+			continue
+		}
+		unixPorts[configs[k].Port] = k
+	}
+	return result
+}
+
+// anyPortKey returns a key for one more port 0 proxy in configs.
+func anyPortKey(configs map[string]ProxyConfig) string {
+	key := "0"
+	for i := 2; ; i++ {
+		if _, found := configs[key]; !found {
+			return key
+		}
+		key = "0#" + strconv.Itoa(i)
 	}
-	result := make([]ProxyConfig, len(configs))
-	i := 0
+}
+
+func sortedProxies(configs map[string]ProxyConfig) []ProxyConfig {
+	keys := sortedProxyKeys(configs)
+	result := make([]ProxyConfig, len(keys))
+	for i, k := range keys {
+		result[i] = configs[k]
+	}
+	return result
+}
+
+// sortedProxyKeys returns the keys of configs sorted by port, then key as there can be many port 0.
+func sortedProxyKeys(configs map[string]ProxyConfig) []string {
+	keys := make([]string, 0, len(configs))
 	for k := range configs {
-		cfg := configs[k]
-		cfg.Port = k
-		configs[k] = cfg
-		result[i] = cfg
-		i += 1
-		//fmt.Printf("%i: %+v\n", k, cfg)
-	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Port < result[j].Port
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, pj := configs[keys[i]].Port, configs[keys[j]].Port
+		if pi != pj {
+			return pi < pj
+		}
+		return keys[i] < keys[j]
 	})
-	return result
+	return keys
+}
+
+// ParseMapping parses port=target[,hold=duration][,listen=address][,nolog=regex][,harsize=n], nolog can be repeated.
+// Options are split on commas followed by option=, other commas are part of the value.
+func ParseMapping(s string) (ProxyMapping, error) {
+	var result ProxyMapping
+	portStr, rest, found := strings.Cut(s, "=")
+	if !found {
+		return result, fmt.Errorf("invalid mapping %q, expecting port=target[,option=value]...", s)
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(portStr))
+	if err != nil || port < 0 {
+		return result, fmt.Errorf("invalid port %q", portStr)
+	}
+	result.port = port
+	options := splitMapping(rest)
+	result.target = strings.TrimSpace(options[0])
+	if _, err = parseTarget(result.target); err != nil {
+		return result, err
+	}
+	for _, option := range options[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "hold":
+			hold, err := time.ParseDuration(value)
+			if err != nil {
+				return result, fmt.Errorf("invalid hold %q", value)
+			}
+			result.hold = &hold
+		case "listen":
+			listen := value
+			result.listen = &listen
+		case "nolog":
+			result.noLog = append(result.noLog, value)
+		case "harsize":
+			harSize, err := strconv.Atoi(value)
+			if err != nil {
+				return result, fmt.Errorf("invalid harsize %q", value)
+			}
+			result.harSize = &harSize
+		default:
+			return result, fmt.Errorf("unknown mapping option %q", key)
+		}
+	}
+	return result, nil
+}
+
+// splitMapping splits s before every option, dropping the commas.
+func splitMapping(s string) []string {
+	var result []string
+	start := 0
+	for _, loc := range mappingOption.FindAllStringIndex(s, -1) {
+		result = append(result, s[start:loc[0]])
+		start = loc[0] + 1
+	}
+	return append(result, s[start:])
+}
+
+func (m ProxyMapping) String() string {
+	return strconv.Itoa(m.port) + "=" + m.target
+}
+
+func (m ProxyMapping) apply(config *ProxyConfig) {
+	config.Port = m.port
+	config.Target = m.target
+	if m.hold != nil {
+		config.Hold = *m.hold
+	}
+	if m.listen != nil {
+		config.Listen = *m.listen
+	}
+	if m.noLog != nil {
+		config.NoLog = m.noLog
+	}
+	if m.harSize != nil {
+		config.HarSize = *m.harSize
+	}
 }
@@ -0,0 +1,499 @@
+package hdproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// maxIncludeDepth stops include loops.
+const maxIncludeDepth = 8
+
+// defaultConfigFiles are tried in order when -config is not given.
+var defaultConfigFiles = []string{"hdproxy.toml", "hdproxy.yaml", "hdproxy.yml", "hdproxy.json"}
+
+// yamlErrorLine extracts line number from yaml parser error.
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+type (
+	// configLoader merges config from files, environment & flags, remembering where each value comes from.
+	//
+	// Top level keys of config file are:
+	//
+	//	include    file patterns to merge after this file, relative to this file
+	//	admin      AdminConfig
+	//	defaults   ProxyConfig inherited by every proxy
+	//	proxies    named proxies, proxies.<name> is a ProxyConfig with explicit Port
+	//	<port>     legacy proxy section, port taken from the key
+	configLoader struct {
+		v *viper.Viper
+		// fname is the main config file
+		fname string
+		// files read so far, in order
+		files []string
+		// lines of every dotted key in the config file it comes from
+		lines map[string]fileLine
+		// sources of values not coming from config file nor environment, e.g. -map flags
+		sources map[string]string
+		// portKeys is the key of every port but 0, e.g. "8080" or "proxies.api"
+		portKeys map[int]string
+		// proxyKeys is the key of every proxy, port 0 ones included
+		proxyKeys []string
+		admin     AdminConfig
+		errs      ConfigErrors
+	}
+
+	fileLine struct {
+		fname string
+		// order of the file in configLoader.files
+		order int
+		line  int
+	}
+
+	// proxySection is a proxy table found in config, not decoded yet.
+	proxySection struct {
+		key   string
+		name  string
+		table map[string]interface{}
+	}
+)
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		v:        newConfigViper(),
+		lines:    make(map[string]fileLine),
+		sources:  make(map[string]string),
+		portKeys: make(map[int]string),
+	}
+}
+
+func newConfigViper() *viper.Viper {
+	v := viper.New()
+	v.SetEnvPrefix("hdproxy")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	return v
+}
+
+// configFormat guess config format from file extension, default to TOML.
+func configFormat(fname string) string {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "toml"
+}
+
+func (l *configLoader) readFile(fname string) error {
+	return l.readFileDepth(fname, 0)
+}
+
+func (l *configLoader) readFileDepth(fname string, depth int) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	if len(l.fname) == 0 {
+		l.fname = fname
+	}
+	return l.read(fname, configFormat(fname), data, depth)
+}
+
+// read merges config data in format into what's read so far, then reads the included files.
+func (l *configLoader) read(fname string, format string, data []byte, depth int) error {
+	if err := checkSyntax(fname, format, data); err != nil {
+		return ConfigErrors{err}
+	}
+	fv := viper.New()
+	fv.SetConfigType(format)
+	if err := fv.ReadConfig(bytes.NewReader(data)); err != nil {
+		return ConfigErrors{{Source: fname, Err: err}}
+	}
+	var lines map[string]int
+	switch format {
+	case "toml":
+		lines = indexTOMLLines(data)
+	case "yaml":
+		lines = indexYAMLLines(data)
+	}
+	// later file overrides earlier one, so does the line
+	l.files = append(l.files, fname)
+	for key, line := range lines {
+		l.lines[key] = fileLine{fname: fname, order: len(l.files), line: line}
+	}
+	settings := fv.AllSettings()
+	include, hasInclude := settings["include"]
+	delete(settings, "include")
+	if err := l.v.MergeConfigMap(settings); err != nil {
+		return ConfigErrors{{Source: fname, Err: err}}
+	}
+	if !hasInclude {
+		return nil
+	}
+
+	var patterns []string
+	if err := decodeValue(include, &patterns); err != nil {
+		return ConfigErrors{l.errorAt(fname, "include", err)}
+	}
+	var errs ConfigErrors
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fname), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, l.errorAt(fname, "include", err))
+			continue
+		}
+		sort.Strings(files)
+		for _, included := range files {
+			if depth >= maxIncludeDepth {
+				errs = append(errs, l.errorAt(fname, "include", fmt.Errorf("too many nested includes at %s", included)))
+				break
+			}
+			if err := l.readFileDepth(included, depth+1); err != nil {
+				var includeErrs ConfigErrors
+				if errors.As(err, &includeErrs) {
+					errs = append(errs, includeErrs...)
+				} else {
+					errs = append(errs, &ConfigError{Source: included, Err: err})
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (l *configLoader) errorAt(fname string, key string, err error) *ConfigError {
+	return &ConfigError{Source: fname, Line: l.lines[key].line, Key: key, Err: err}
+}
+
+// checkSyntax reports syntax error with its line, viper doesn't keep the position.
+func checkSyntax(fname string, format string, data []byte) *ConfigError {
+	switch format {
+	case "toml":
+		return checkTOML(fname, data)
+	case "json":
+		var doc interface{}
+		err := json.Unmarshal(data, &doc)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return &ConfigError{Source: fname, Line: line, Err: err}
+		} else if err != nil {
+			return &ConfigError{Source: fname, Err: err}
+		}
+	case "yaml":
+		fv := viper.New()
+		fv.SetConfigType(format)
+		if err := fv.ReadConfig(bytes.NewReader(data)); err != nil {
+			result := &ConfigError{Source: fname, Err: err}
+			if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+				result.Line, _ = strconv.Atoi(m[1])
+			}
+			return result
+		}
+	}
+	return nil
+}
+
+// proxies decodes every proxy section by key, collecting invalid keys & values into l.errs.
+func (l *configLoader) proxies() map[string]ProxyConfig {
+	configs := make(map[string]ProxyConfig)
+	settings := l.v.AllSettings()
+
+	var errs ConfigErrors
+	defaults, _ := settings["defaults"].(map[string]interface{})
+	if defaults != nil {
+		// only to report problems in defaults once, instead of on every proxy inheriting them
+		decodeTable("defaults", defaults, reflect.ValueOf(&ProxyConfig{}).Elem(), &errs)
+	}
+	if admin, ok := settings["admin"].(map[string]interface{}); ok {
+		decodeTable("admin", admin, reflect.ValueOf(&l.admin).Elem(), &errs)
+	}
+
+	var sections []proxySection
+	for key, raw := range settings {
+		switch key {
+		case "defaults", "admin":
+			continue
+		case "proxies":
+			named, ok := raw.(map[string]interface{})
+			if !ok {
+				errs.add(key, "expecting a table of named proxies")
+				continue
+			}
+			for name, raw := range named {
+				sections = append(sections, l.section("proxies."+name, name, raw, &errs))
+			}
+		default:
+			if _, err := strconv.Atoi(key); err != nil {
+				errs.add(key, "unknown key")
+				continue
+			}
+			sections = append(sections, l.section(key, "", raw, &errs))
+		}
+	}
+	// keep the file order, so duplicate is the later one, sections only from environment come last
+	sort.Slice(sections, func(i, j int) bool {
+		li, lj := l.lines[sections[i].key], l.lines[sections[j].key]
+		if li.order != lj.order {
+			return lj.order == 0 || li.order != 0 && li.order < lj.order
+		}
+		if li.line != lj.line {
+			return li.line < lj.line
+		}
+		return sections[i].key < sections[j].key
+	})
+
+	for _, section := range sections {
+		if section.table == nil {
+			continue
+		}
+		var port int
+		if len(section.name) == 0 {
+			port, _ = strconv.Atoi(section.key)
+		} else if raw, found := section.table["port"]; !found {
+			errs.add(section.key, "port is required")
+			continue
+		} else if err := decodeValue(raw, &port); err != nil {
+			errs.add(section.key+".port", "%v", err)
+			continue
+		}
+		if port < 0 || port > 65535 {
+			errs.add(section.key, "invalid port %d", port)
+			continue
+		}
+		// port 0 picks any free port, so there can be many
+		if first, found := l.portKeys[port]; found && port != 0 {
+			if _, inFile := l.lines[section.key]; !inFile && len(section.name) == 0 {
+				// HDPROXY_<PORT>_<KEY> of a named proxy
+				cfg := configs[first]
+				decodeTable(section.key, section.table, reflect.ValueOf(&cfg).Elem(), &errs)
+				configs[first] = cfg
+				continue
+			}
+			errs.add(section.key, "duplicate port %d, already defined as [%s]", port, first)
+			continue
+		}
+		if port != 0 {
+			l.portKeys[port] = section.key
+		}
+		l.proxyKeys = append(l.proxyKeys, section.key)
+
+		var sectionErrs ConfigErrors
+		cfg := ProxyConfig{}
+		decodeTable(section.key, mergeTables(defaults, section.table), reflect.ValueOf(&cfg).Elem(), &sectionErrs)
+		for _, err := range sectionErrs {
+			if hasPath(section.table, strings.TrimPrefix(err.Key, section.key+".")) {
+				errs = append(errs, err)
+			}
+		}
+		cfg.Port = port
+		cfg.Name = section.name
+		configs[section.key] = cfg
+	}
+	l.addErrors(errs)
+	return configs
+}
+
+func (l *configLoader) section(key string, name string, raw interface{}, errs *ConfigErrors) proxySection {
+	table, ok := raw.(map[string]interface{})
+	if !ok {
+		errs.add(key, "expecting a table of proxy settings")
+	}
+	return proxySection{key: key, name: name, table: table}
+}
+
+// mergeTables returns a copy of defaults overridden by table, sub tables are merged as well.
+func mergeTables(defaults map[string]interface{}, table map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(defaults)+len(table))
+	for k, v := range defaults {
+		result[k] = v
+	}
+	for k, v := range table {
+		sub, isTable := v.(map[string]interface{})
+		defaultSub, isDefaultTable := result[k].(map[string]interface{})
+		if isTable && isDefaultTable {
+			result[k] = mergeTables(defaultSub, sub)
+		} else {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// hasPath reports whether dotted key exists in table.
+func hasPath(table map[string]interface{}, key string) bool {
+	var current interface{} = table
+	for _, part := range strings.Split(key, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			var found bool
+			if current, found = v[part]; !found {
+				return false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return false
+			}
+			current = v[i]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// portKey returns the key of the proxy on port, e.g. "proxies.api", or the port itself when there's none.
+func (l *configLoader) portKey(port int) string {
+	if k, found := l.portKeys[port]; found {
+		return k
+	}
+	return strconv.Itoa(port)
+}
+
+// validate checks cfg, the proxy with key.
+func (l *configLoader) validate(key string, cfg ProxyConfig) {
+	errs := cfg.Validate()
+	prefix := key
+	for _, err := range errs {
+		err.Key = prefix + "." + err.Key
+	}
+	l.addErrors(errs)
+}
+
+// addErrors adds errs after filling in where the value comes from, if not known yet.
+func (l *configLoader) addErrors(errs ConfigErrors) {
+	for _, err := range errs {
+		if len(err.Source) == 0 {
+			err.Source, err.Line = l.context(err.Key)
+		}
+		l.errs = append(l.errs, err)
+	}
+}
+
+// context finds where key, or its closest parent, is set.
+// Proxy keys not set in the proxy section itself are looked up in defaults.
+func (l *configLoader) context(key string) (string, int) {
+	proxyKey := ""
+	for _, k := range l.proxyKeys {
+		if strings.HasPrefix(key, k+".") {
+			proxyKey = k
+		}
+	}
+	for k := key; len(k) > 0; {
+		if source, found := l.sources[k]; found {
+			return source, 0
+		}
+		if envName := envConfigName(k); isEnvSet(envName) {
+			return "$" + envName, 0
+		}
+		if fl, found := l.lines[k]; found {
+			return fl.fname, fl.line
+		}
+		if len(proxyKey) > 0 && strings.HasPrefix(k, proxyKey+".") {
+			if fl, found := l.lines["defaults"+strings.TrimPrefix(k, proxyKey)]; found {
+				return fl.fname, fl.line
+			}
+		}
+		i := strings.LastIndex(k, ".")
+		if i < 0 {
+			break
+		}
+		k = k[:i]
+	}
+	return l.fname, 0
+}
+
+func (l *configLoader) setMappingSources(key string, m ProxyMapping) {
+	source := "-map " + strconv.Itoa(m.port)
+	l.sources[key+".target"] = source
+	if m.hold != nil {
+		l.sources[key+".hold"] = source
+	}
+	if m.listen != nil {
+		l.sources[key+".listen"] = source
+	}
+	if m.noLog != nil {
+		l.sources[key+".nolog"] = source
+	}
+	if m.harSize != nil {
+		l.sources[key+".harsize"] = source
+	}
+}
+
+func hasEnvProxies() bool {
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if envProxyKey.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindEnvProxies makes viper aware of proxies only configured from environment,
+// those already in config file are covered by AutomaticEnv.
+func bindEnvProxies(v *viper.Viper) {
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if !envProxyKey.MatchString(name) {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, "HDPROXY_"), "_", "."))
+		if err := v.BindEnv(key); err != nil {
+			fmt.Fprintln(os.Stderr, "Ignoring environment variable", name, ", error:", err)
+		}
+	}
+}
+
+// indexYAMLLines maps every dotted lowercase key in YAML data to its first line, by following indentation.
+// Like indexTOMLLines, it's only good enough to point where the problem is.
+func indexYAMLLines(data []byte) map[string]int {
+	type level struct {
+		indent int
+		key    string
+	}
+	result := make(map[string]int)
+	var stack []level
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		key, _, found := strings.Cut(trimmed, ":")
+		if !found {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key = strings.ToLower(strings.Trim(strings.TrimSpace(key), `"'`))
+		if len(stack) > 0 {
+			key = stack[len(stack)-1].key + "." + key
+		}
+		stack = append(stack, level{indent: indent, key: key})
+		if _, found := result[key]; !found {
+			result[key] = i + 1
+		}
+	}
+	return result
+}
@@ -0,0 +1,276 @@
+package hdproxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMapping(t *testing.T) {
+	hold := 2 * time.Second
+	harSize := 10
+	tests := []struct {
+		name    string
+		s       string
+		want    ProxyMapping
+		wantErr bool
+	}{
+		{
+			name: "target only",
+			s:    "8080=https://a",
+			want: ProxyMapping{port: 8080, target: "https://a"},
+		},
+		{
+			name: "options",
+			s:    "8080=https://a/api,hold=2s,nolog=^/health,nolog=^/metrics,harsize=10",
+			want: ProxyMapping{port: 8080, target: "https://a/api", hold: &hold, noLog: []string{"^/health", "^/metrics"}, harSize: &harSize},
+		},
+		{
+			name: "comma in value",
+			s:    "8080=https://a,nolog=^/a{1,3}, hold=2s",
+			want: ProxyMapping{port: 8080, target: "https://a", hold: &hold, noLog: []string{"^/a{1,3}"}},
+		},
+		{
+			name:    "no target",
+			s:       "8080",
+			wantErr: true,
+		},
+		{
+			name:    "invalid target",
+			s:       "8080=a",
+			wantErr: true,
+		},
+		{
+			name:    "unknown option",
+			s:       "8080=https://a,foo=bar",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMapping(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseMapping() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMapping() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvProxies(t *testing.T) {
+	t.Setenv("HDPROXY_8080_HOLD", "5s")
+	t.Setenv("HDPROXY_9090_TARGET", "https://b")
+	t.Setenv("HDPROXY_9090_NOLOG", "^/a{1,3},^/b,^/[,(]")
+
+	l := newConfigLoader()
+	if err := l.read("", "toml", []byte("[8080]\nTarget=\"https://a\"\nHold=\"1s\"\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	bindEnvProxies(l.v)
+	got := sortedProxies(l.proxies())
+	want := []ProxyConfig{
+		{Port: 8080, Target: "https://a", Hold: 5 * time.Second},
+		{Port: 9090, Target: "https://b", NoLog: []string{"^/a{1,3}", "^/b", "^/[,(]"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("env proxies got = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadConfig_Errors(t *testing.T) {
+	config := `[8080]
+Target = "google.com"
+Hold = "2x"
+NoLog = ["(", "^/ok"]
+Unknown = 1
+
+[08080]
+Target = "https://a"
+
+[8081]
+Target = "https://b"
+[8081.Redact]
+Mode = "blur"
+`
+	_, err := ReadConfig(strings.NewReader(config))
+	want := []string{
+		"line 3: 8080.hold: time: unknown unit \"x\" in duration \"2x\"",
+		"line 5: 8080.unknown: unknown key",
+		"line 7: 08080: duplicate port 8080, already defined as [8080]",
+		"line 2: 8080.target: invalid target url \"google.com\", must be http(s)://host[:port][/path]",
+		"line 4: 8080.nolog: invalid regex \"(\"",
+		"line 12: 8081.redact: invalid redact mode \"blur\"",
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("ReadConfig() error = %v, want ConfigErrors", err)
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("ReadConfig() got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if !strings.Contains(errs[i].Error(), w) {
+			t.Errorf("ReadConfig() error %d got = %v, want %v", i, errs[i], w)
+		}
+	}
+
+	_, err = ReadConfig(strings.NewReader("[8080]\nTarget = \"https://a\"\nHold = 2x\n"))
+	if errs, ok := err.(ConfigErrors); !ok || errs[0].Line != 3 {
+		t.Errorf("ReadConfig() syntax error got = %v, want error at line 3", err)
+	}
+}
+
+func TestReadConfig_AnyPort(t *testing.T) {
+	config := `[proxies.a]
+Port = 0
+Target = "https://a"
+
+[proxies.b]
+Port = 0
+Target = "https://b"
+Hold = "x"
+`
+	_, err := ReadConfig(strings.NewReader(config))
+	if err == nil || err.Error() != "line 8: proxies.b.hold: time: invalid duration \"x\"" {
+		t.Errorf("ReadConfig() error got = %v", err)
+	}
+	got, err := ReadConfig(strings.NewReader(strings.Replace(config, "Hold = \"x\"\n", "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "a" || got[1].Name != "b" || got[0].Port != 0 || got[1].Port != 0 {
+		t.Errorf("ReadConfig() got = %+v", got)
+	}
+}
+
+func TestLoad_DefaultsAndIncludes(t *testing.T) {
+	dir := t.TempDir()
+	main := `include = ["conf.d/*.yaml"]
+
+[admin]
+Addr = "127.0.0.1:9090"
+
+[defaults]
+Hold = "1s"
+NoLog = ["^/health"]
+[defaults.Redact]
+Headers = ["Authorization"]
+
+[proxies.api]
+Port = 8080
+Target = "https://a"
+NoLog = []
+
+[8081]
+Target = "https://b"
+Hold = "2s"
+`
+	included := `proxies:
+  web:
+    port: 8082
+    target: https://c
+    redact:
+      cookies: [session]
+`
+	if err := os.WriteFile(filepath.Join(dir, "hdproxy.toml"), []byte(main), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "web.yaml"), []byte(included), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := ConfigOptions{File: filepath.Join(dir, "hdproxy.toml")}
+	got, err := o.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Proxies: []ProxyConfig{
+			{Name: "api", Port: 8080, Target: "https://a", Hold: time.Second, NoLog: []string{},
+				Redact: RedactConfig{Headers: []string{"Authorization"}}},
+			{Port: 8081, Target: "https://b", Hold: 2 * time.Second, NoLog: []string{"^/health"},
+				Redact: RedactConfig{Headers: []string{"Authorization"}}},
+			{Name: "web", Port: 8082, Target: "https://c", Hold: time.Second, NoLog: []string{"^/health"},
+				Redact: RedactConfig{Headers: []string{"Authorization"}, Cookies: []string{"session"}}},
+		},
+		Admin: AdminConfig{Addr: "127.0.0.1:9090"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() got = %+v, want %+v", got, want)
+	}
+
+	// errors in included file point to it
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "web.yaml"), []byte("proxies:\n  web:\n    target: https://c\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.Load()
+	wantErr := filepath.Join(dir, "conf.d", "web.yaml") + ":2: proxies.web: port is required"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Load() error got = %v, want %v", err, wantErr)
+	}
+}
+
+func TestPrintConfig_MasksSecrets(t *testing.T) {
+	config := Config{
+		Admin: AdminConfig{Addr: ":9000", Token: "admintoken"},
+		Proxies: []ProxyConfig{{Port: 8080, Target: "http://localhost:9090", Auth: AuthConfig{
+			Basic:  []string{"alice:s3cret"},
+			Bearer: []string{"ci:tok123"},
+		}, Redact: RedactConfig{Mode: RedactModeHash, HashKey: "hashkey"}}},
+	}
+	var out bytes.Buffer
+	PrintConfig(&out, config)
+	for _, secret := range []string{"admintoken", "s3cret", "tok123", "hashkey"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("secret %q printed:\n%s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), `Basic = ["alice:REDACTED"]`) || !strings.Contains(out.String(), `Bearer = ["ci:REDACTED"]`) {
+		t.Errorf("auth names missing:\n%s", out.String())
+	}
+	if config.Proxies[0].Auth.Basic[0] != "alice:s3cret" {
+		t.Error("config modified")
+	}
+}
+
+func TestLoad_AnyPortMappings(t *testing.T) {
+	var options ConfigOptions
+	for _, s := range []string{"0=https://a", "0=https://b,listen=127.0.0.1"} {
+		m, err := ParseMapping(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.Mappings = append(options.Mappings, m)
+	}
+	config, err := options.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Proxies; len(got) != 2 || got[0].Target != "https://a" || got[1].Target != "https://b" {
+		t.Errorf("Load() got = %+v, want both port 0 mappings", got)
+	}
+
+	_, err = ReadConfig(strings.NewReader(`[proxies.a]
+Port = 0
+Target = "https://a"
+Listen = "unix:/tmp/a.sock"
+
+[proxies.b]
+Port = 0
+Target = "https://b"
+Listen = "unix:/tmp/b.sock"
+`))
+	if err == nil || !strings.Contains(err.Error(), "proxies.b.port: port 0 already used by unix socket proxy [proxies.a]") {
+		t.Errorf("ReadConfig() of unix sockets on same port got = %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package hdproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// alwaysIgnoredHeaders differ on every response, comparing them is only noise.
+var alwaysIgnoredHeaders = []string{"Date", "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive"}
+
+type (
+	// DiffConfig are the parts left out when comparing two responses.
+	DiffConfig struct {
+		// IgnoreHeaders are header names, besides Date, Content-Length & the like.
+		IgnoreHeaders []string
+		// IgnoreJSON are paths in JSON body, same syntax as RedactConfig.JSON, e.g. "meta.requestId".
+		IgnoreJSON []string
+	}
+
+	// differ compares responses, reporting each difference as a line.
+	differ struct {
+		headers map[string]bool
+		// ignoreJSON masks ignored JSON paths on both sides, so they compare equal
+		ignoreJSON *Redactor
+	}
+
+	// diffSide is one of the responses compared.
+	diffSide struct {
+		Status int
+		Header http.Header
+		Body   []byte
+	}
+)
+
+func newDiffer(config DiffConfig) (*differ, error) {
+	ignoreJSON, err := NewRedactor(RedactConfig{JSON: config.IgnoreJSON})
+	if err != nil {
+		return nil, err
+	}
+	result := &differ{headers: make(map[string]bool), ignoreJSON: ignoreJSON}
+	for _, name := range append(alwaysIgnoredHeaders, config.IgnoreHeaders...) {
+		result.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	return result, nil
+}
+
+// Diff returns the differences between a & b, empty if they're the same.
+func (d *differ) Diff(a, b diffSide) []string {
+	var result []string
+	if a.Status != b.Status {
+		result = append(result, fmt.Sprintf("status: %d != %d", a.Status, b.Status))
+	}
+	result = append(result, d.diffHeaders(a.Header, b.Header)...)
+	return append(result, d.diffBodies(a, b)...)
+}
+
+func (d *differ) diffHeaders(a, b http.Header) []string {
+	names := make(map[string]bool)
+	for name := range a {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range b {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !d.headers[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	var result []string
+	for _, name := range sorted {
+		va, vb := strings.Join(a.Values(name), ", "), strings.Join(b.Values(name), ", ")
+		_, inA := a[name]
+		_, inB := b[name]
+		if va == vb && inA == inB {
+			continue
+		}
+		result = append(result, fmt.Sprintf("header %s: %s != %s", name, headerDiffValue(inA, va), headerDiffValue(inB, vb)))
+	}
+	return result
+}
+
+func headerDiffValue(found bool, value string) string {
+	if !found {
+		return "<missing>"
+	}
+	return strconv.Quote(value)
+}
+
+func (d *differ) diffBodies(a, b diffSide) []string {
+	if isJSON(a.Header) && isJSON(b.Header) {
+		docA, errA := decodeJSON(d.ignoreJSON.Body("application/json", a.Body))
+		docB, errB := decodeJSON(d.ignoreJSON.Body("application/json", b.Body))
+		if errA == nil && errB == nil {
+			var result []string
+			diffJSON("", docA, docB, &result)
+			return result
+		}
+	}
+	if bytes.Equal(a.Body, b.Body) {
+		return nil
+	}
+	if len(a.Body) != len(b.Body) {
+		return []string{fmt.Sprintf("body: %d bytes != %d bytes", len(a.Body), len(b.Body))}
+	}
+	return []string{fmt.Sprintf("body: differs, both %d bytes", len(a.Body))}
+}
+
+func isJSON(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&result)
+	return result, err
+}
+
+// diffJSON appends a line for each path where a & b differ, paths use the syntax of DiffConfig.IgnoreJSON.
+func diffJSON(path string, a, b interface{}, result *[]string) {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		if vb, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(va)+len(vb))
+			for k := range va {
+				keys = append(keys, k)
+			}
+			for k := range vb {
+				if _, found := va[k]; !found {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				childA, inA := va[k]
+				childB, inB := vb[k]
+				childPath := joinJSONPath(path, k)
+				if !inA || !inB {
+					*result = append(*result, fmt.Sprintf("body%s: %s != %s", jsonPathLabel(childPath), jsonDiffValue(inA, childA), jsonDiffValue(inB, childB)))
+					continue
+				}
+				diffJSON(childPath, childA, childB, result)
+			}
+			return
+		}
+	case []interface{}:
+		if vb, ok := b.([]interface{}); ok {
+			for i := 0; i < len(va) || i < len(vb); i++ {
+				childPath := joinJSONPath(path, strconv.Itoa(i))
+				if i >= len(va) || i >= len(vb) {
+					*result = append(*result, fmt.Sprintf("body%s: %s != %s", jsonPathLabel(childPath),
+						jsonDiffValue(i < len(va), itemAt(va, i)), jsonDiffValue(i < len(vb), itemAt(vb, i))))
+					continue
+				}
+				diffJSON(childPath, va[i], vb[i], result)
+			}
+			return
+		}
+	case json.Number:
+		if vb, ok := b.(json.Number); ok {
+			fa, errA := va.Float64()
+			fb, errB := vb.Float64()
+			if errA == nil && errB == nil && fa == fb {
+				return
+			}
+		}
+	}
+	if ja, jb := jsonDiffValue(true, a), jsonDiffValue(true, b); ja != jb {
+		*result = append(*result, fmt.Sprintf("body%s: %s != %s", jsonPathLabel(path), ja, jb))
+	}
+}
+
+func joinJSONPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonPathLabel is how path is shown after "body", nothing for the whole body.
+func jsonPathLabel(path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return " " + path
+}
+
+func itemAt(items []interface{}, i int) interface{} {
+	if i < len(items) {
+		return items[i]
+	}
+	return nil
+}
+
+func jsonDiffValue(found bool, v interface{}) string {
+	if !found {
+		return "<missing>"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
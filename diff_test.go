@@ -0,0 +1,60 @@
+package hdproxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDiffer_Diff(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {"application/json"}, "Date": {"Mon"}}
+	tests := []struct {
+		name   string
+		config DiffConfig
+		a, b   diffSide
+		want   []string
+	}{
+		{
+			name: "same",
+			a:    diffSide{Status: 200, Header: jsonHeader, Body: []byte(`{"a":1,"b":[1,2]}`)},
+			b:    diffSide{Status: 200, Header: http.Header{"Content-Type": {"application/json"}, "Date": {"Tue"}}, Body: []byte(`{"b":[1,2],"a":1.0}`)},
+			want: nil,
+		},
+		{
+			name: "status & headers",
+			a:    diffSide{Status: 200, Header: http.Header{"X-A": {"1"}, "X-B": {"1"}}},
+			b:    diffSide{Status: 500, Header: http.Header{"X-B": {"2"}}},
+			want: []string{"status: 200 != 500", `header X-A: "1" != <missing>`, `header X-B: "1" != "2"`},
+		},
+		{
+			name: "json paths",
+			a:    diffSide{Status: 200, Header: jsonHeader, Body: []byte(`{"user":{"id":1,"name":"a"},"items":[1,2],"only":true}`)},
+			b:    diffSide{Status: 200, Header: jsonHeader, Body: []byte(`{"user":{"id":1,"name":"b"},"items":[1,2,3],"extra":null}`)},
+			want: []string{"body extra: <missing> != null", "body items.2: <missing> != 3", `body only: true != <missing>`, `body user.name: "a" != "b"`},
+		},
+		{
+			name:   "ignored",
+			config: DiffConfig{IgnoreHeaders: []string{"x-request-id"}, IgnoreJSON: []string{"meta.*"}},
+			a:      diffSide{Status: 200, Header: http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"1"}}, Body: []byte(`{"meta":{"t":1},"v":1}`)},
+			b:      diffSide{Status: 200, Header: http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"2"}}, Body: []byte(`{"meta":{"t":2},"v":1}`)},
+			want:   nil,
+		},
+		{
+			name: "text",
+			a:    diffSide{Status: 200, Header: http.Header{}, Body: []byte("abc")},
+			b:    diffSide{Status: 200, Header: http.Header{}, Body: []byte("abcd")},
+			want: []string{"body: 3 bytes != 4 bytes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDiffer(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.Diff(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package hdproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultDrainTimeout is how long shutdown waits for requests & WebSockets in flight by default.
+const DefaultDrainTimeout = 60 * time.Second
+
+type (
+	// inFlight are the exchanges & WebSockets of a proxy in progress, so shutdown can drain & report them.
+	inFlight struct {
+		mutex      sync.Mutex
+		exchanges  map[*exchange]flight
+		webSockets map[*webSocketPair]struct{}
+		// draining is closed when the proxy shuts down, gate, hold & breakpoints let requests go then
+		draining chan struct{}
+	}
+
+	flight struct {
+		method string
+		uri    string
+		// forwarded is set once the request is past gate & hold
+		forwarded bool
+	}
+
+	// flightLine is a line of the in flight report.
+	flightLine struct {
+		since time.Time
+		text  string
+	}
+
+	webSocketPair struct {
+		remoteAddr string
+		path       string
+		since      time.Time
+		client     *websocket.Conn
+		upstream   *websocket.Conn
+	}
+)
+
+func (f *inFlight) add(ex *exchange, method, uri string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.exchanges == nil {
+		f.exchanges = make(map[*exchange]flight)
+	}
+	f.exchanges[ex] = flight{method: method, uri: uri}
+}
+
+func (f *inFlight) forwarded(ex *exchange) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if fl, found := f.exchanges[ex]; found {
+		fl.forwarded = true
+		f.exchanges[ex] = fl
+	}
+}
+
+func (f *inFlight) remove(ex *exchange) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.exchanges, ex)
+}
+
+func (f *inFlight) addWebSocket(ws *webSocketPair) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.webSockets == nil {
+		f.webSockets = make(map[*webSocketPair]struct{})
+	}
+	f.webSockets[ws] = struct{}{}
+}
+
+func (f *inFlight) removeWebSocket(ws *webSocketPair) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.webSockets, ws)
+}
+
+// drained returns the channel closed once the proxy shuts down.
+func (f *inFlight) drained() <-chan struct{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.draining == nil {
+		f.draining = make(chan struct{})
+	}
+	return f.draining
+}
+
+// reset gets ready for the proxy to start again after a shutdown.
+func (f *inFlight) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.draining = make(chan struct{})
+}
+
+// drain lets held & paused requests go, and asks both sides of every WebSocket to close.
+func (f *inFlight) drain() {
+	f.mutex.Lock()
+	if f.draining == nil {
+		f.draining = make(chan struct{})
+	}
+	select {
+	case <-f.draining:
+	default:
+		close(f.draining)
+	}
+	webSockets := make([]*webSocketPair, 0, len(f.webSockets))
+	for ws := range f.webSockets {
+		webSockets = append(webSockets, ws)
+	}
+	f.mutex.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy shutting down")
+	deadline := time.Now().Add(time.Second)
+	for _, ws := range webSockets {
+		ws.client.WriteControl(websocket.CloseMessage, msg, deadline)
+		ws.upstream.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+}
+
+// waitWebSockets waits for every WebSocket to be closed, false when ctx is done first.
+// srv.Shutdown doesn't wait for them as they're hijacked.
+func (f *inFlight) waitWebSockets(ctx context.Context) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		f.mutex.Lock()
+		open := len(f.webSockets)
+		f.mutex.Unlock()
+		if open == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// report writes what's still in flight to w, oldest first, then closes the WebSockets left.
+func (f *inFlight) report(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var lines []flightLine
+	now := time.Now()
+	for ex, fl := range f.exchanges {
+		state := "waiting for upstream"
+		if !fl.forwarded {
+			state = "not forwarded yet"
+		}
+		text := fmt.Sprintf("still in flight: %s %s %d for %v, %s", fl.method, fl.uri, ex.id, now.Sub(ex.start).Round(time.Millisecond), state)
+		lines = append(lines, flightLine{ex.start, text})
+	}
+	for ws := range f.webSockets {
+		text := fmt.Sprintf("still in flight: WS %s from %s open for %v, closed", ws.path, ws.remoteAddr, now.Sub(ws.since).Round(time.Millisecond))
+		lines = append(lines, flightLine{ws.since, text})
+		ws.client.Close()
+		ws.upstream.Close()
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].since.Before(lines[j].since)
+	})
+	for _, line := range lines {
+		fmt.Fprintln(w, line.text)
+	}
+}
+
+// drain shuts srv down gracefully: held & paused requests go on, WebSockets get close frames,
+// what's still in flight when ctx is done is reported & cut.
+func (p *Proxy) drain(ctx context.Context, srv *http.Server) {
+	p.flights.drain()
+	err := srv.Shutdown(ctx)
+	if p.flights.waitWebSockets(ctx) && err == nil {
+		return
+	}
+	fmt.Fprintln(p.logWriter, "drain timed out")
+	p.flights.report(p.logWriter)
+	srv.Close()
+}
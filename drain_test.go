@@ -0,0 +1,103 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestProxy_DrainHold(t *testing.T) {
+	var log bytes.Buffer
+	p := &Proxy{logWriter: &log}
+	held := &exchange{id: 1, start: time.Now().Add(-time.Second), settings: &proxySettings{hold: time.Minute}}
+	p.flights.add(held, http.MethodGet, "/held")
+	queued := &exchange{id: 2, start: time.Now(), settings: &proxySettings{}}
+	p.flights.add(queued, http.MethodPost, "/queued")
+
+	done := make(chan bool)
+	go func() {
+		done <- p.hold(httptest.NewRequest(http.MethodGet, "/held", nil), held)
+	}()
+	p.flights.drain()
+	select {
+	case forwarded := <-done:
+		if !forwarded {
+			t.Error("hold cut short by shutdown didn't forward the request")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hold not cut short by shutdown")
+	}
+	if !strings.Contains(log.String(), `"HOLD GET /held" cut short by shutdown`) {
+		t.Errorf("log got %q", log.String())
+	}
+
+	log.Reset()
+	p.flights.report(&log)
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "still in flight: GET /held 1 for 1") || !strings.HasSuffix(lines[0], "waiting for upstream") ||
+		!strings.HasPrefix(lines[1], "still in flight: POST /queued 2 for") || !strings.HasSuffix(lines[1], "not forwarded yet") {
+		t.Errorf("report got %q", lines)
+	}
+
+	// a restarted proxy holds again
+	p.flights.reset()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if p.hold(httptest.NewRequest(http.MethodGet, "/held", nil).WithContext(ctx), &exchange{id: 3, settings: held.settings}) {
+		t.Error("hold after restart still cut short")
+	}
+}
+
+func TestProxy_DrainWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+	targetUrl, _ := url.Parse(upstream.URL)
+	p := &Proxy{logWriter: io.Discard}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.handleWebSocket(w, r, &exchange{id: 1, start: time.Now(), settings: &proxySettings{targetUrl: targetUrl}})
+	}))
+	defer srv.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for open := 0; open == 0; time.Sleep(time.Millisecond) {
+		p.flights.mutex.Lock()
+		open = len(p.flights.webSockets)
+		p.flights.mutex.Unlock()
+	}
+	p.flights.drain()
+	_, _, err = client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("client got %v, want going away close frame", err)
+	}
+	// answering the close frame ends the pair
+	client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	if !p.flights.waitWebSockets(ctx) {
+		t.Error("WebSocket still open after drain")
+	}
+}
@@ -0,0 +1,186 @@
+package hdproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+type (
+	// Dump is an exchange read back from log/<port>/<id>-req & <id>-resp files.
+	Dump struct {
+		ID    int64
+		Start time.Time
+		// End is the time response file was written, zero when there is no response.
+		End time.Time
+		// URL is the upstream URL the request was sent to.
+		URL          *url.URL
+		Request      *http.Request
+		RequestBody  []byte
+		Response     *http.Response
+		ResponseBody []byte
+	}
+)
+
+// ReadDumpDir reads every dump in dir, sorted by ID (which is also start time).
+func ReadDumpDir(dir string) ([]*Dump, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*-req"))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Dump, 0, len(files))
+	for _, fname := range files {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(fname), "-req"), 10, 64)
+		if err != nil {
+			continue
+		}
+		d, err := ReadDump(dir, id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// ReadDumpFile reads the dump of fname, either the -req or -resp file.
+func ReadDumpFile(fname string) (*Dump, error) {
+	base := filepath.Base(fname)
+	base = strings.TrimSuffix(strings.TrimSuffix(base, "-req"), "-resp")
+	id, err := strconv.ParseInt(base, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a dump file", fname)
+	}
+	return ReadDump(filepath.Dir(fname), id)
+}
+
+// ReadDump reads the dump with id from dir, response is left nil if the -resp file doesn't exist.
+func ReadDump(dir string, id int64) (*Dump, error) {
+	reqFn := filepath.Join(dir, fmt.Sprintf("%d-req", id))
+	data, err := os.ReadFile(reqFn)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dump{ID: id, Start: time.Unix(0, id)}
+	summary, dump := splitDumpSummary(data)
+	head, body := splitDumpBody(dump)
+	d.Request, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", reqFn, err)
+	}
+	d.RequestBody = dechunk(d.Request.TransferEncoding, body)
+	d.URL = dumpSummaryURL(summary)
+	if d.URL == nil {
+		d.URL = &url.URL{Scheme: "http", Host: d.Request.Host, Path: d.Request.URL.Path, RawQuery: d.Request.URL.RawQuery}
+	}
+
+	respFn := filepath.Join(dir, fmt.Sprintf("%d-resp", id))
+	data, err = os.ReadFile(respFn)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if fInfo, err := os.Stat(respFn); err == nil {
+		d.End = fInfo.ModTime()
+	}
+	_, dump = splitDumpSummary(data)
+	head, body = splitDumpBody(dump)
+	d.Response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), d.Request)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", respFn, err)
+	}
+	d.ResponseBody = dechunk(d.Response.TransferEncoding, body)
+	return d, nil
+}
+
+// splitDumpSummary splits the printReq/printResp line from the http dump following it.
+func splitDumpSummary(data []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, data
+	}
+	return data[:i], data[i+1:]
+}
+
+// splitDumpBody splits head and body of http dump, we don't rely on Content-Length since redaction could change body length.
+func splitDumpBody(dump []byte) ([]byte, []byte) {
+	i := bytes.Index(dump, []byte("\r\n\r\n"))
+	if i < 0 {
+		return append(dump, "\r\n\r\n"...), nil
+	}
+	return dump[:i+4], dump[i+4:]
+}
+
+// dumpSummaryURL takes the URL out of printReq line: scheme | host | url | path | query | header.
+func dumpSummaryURL(summary []byte) *url.URL {
+	fields := strings.Split(string(summary), " | ")
+	if len(fields) < 3 {
+		return nil
+	}
+	u, err := url.Parse(strings.TrimSpace(fields[2]))
+	if err != nil || !u.IsAbs() {
+		return nil
+	}
+	return u
+}
+
+func dechunk(transferEncoding []string, body []byte) []byte {
+	if len(transferEncoding) == 0 || transferEncoding[0] != "chunked" {
+		return body
+	}
+	result, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+	if err != nil && len(result) == 0 {
+		return body
+	}
+	return result
+}
+
+// Entry converts d into HAR entry.
+func (d *Dump) Entry() *harlog.Entry {
+	req := d.Request.Clone(d.Request.Context())
+	req.URL = d.URL
+	entry := &harlog.Entry{
+		ID:              strconv.FormatInt(d.ID, 10),
+		StartedDateTime: harlog.Time(d.Start),
+		Request:         harlog.NewRequest(req, d.RequestBody),
+		Cache:           &harlog.Cache{},
+		Timings: &harlog.Timings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+		},
+	}
+	if d.Response == nil {
+		entry.Response = &harlog.Response{
+			Cookies:     []*harlog.Cookie{},
+			Headers:     []*harlog.NVP{},
+			Content:     &harlog.Content{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		return entry
+	}
+	entry.Response = harlog.NewResponse(d.Response, d.ResponseBody)
+	if !d.End.IsZero() && d.End.After(d.Start) {
+		entry.Time = harlog.Duration(d.End.Sub(d.Start))
+		entry.Timings.Wait = entry.Time
+	}
+	return entry
+}
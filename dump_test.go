@@ -0,0 +1,59 @@
+package hdproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDump(t *testing.T) {
+	dir := t.TempDir()
+	req := "http | example.com | http://example.com/api/orders?x=1 | /api/orders | x=1 | map[Content-Type:[application/json]]\n" +
+		"POST /orders?x=1 HTTP/1.1\r\nHost: localhost:8080\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n" +
+		`{"id":1}`
+	resp := "http | example.com | http://example.com/api/orders?x=1 | /api/orders | x=1 | map[]\n" +
+		"HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\nContent-Type: text/plain\r\n\r\n" +
+		"2\r\nok\r\n0\r\n\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "1700000000000000000-req"), []byte(req), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1700000000000000000-resp"), []byte(resp), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1700000000000000001-req"), []byte(req), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dumps, err := ReadDumpDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 2 {
+		t.Fatalf("ReadDumpDir() got %d dumps, want 2", len(dumps))
+	}
+	d := dumps[0]
+	if got := d.URL.String(); got != "http://example.com/api/orders?x=1" {
+		t.Errorf("URL got = %v", got)
+	}
+	// body is taken as is, ignoring the stale Content-Length
+	if got := string(d.RequestBody); got != `{"id":1}` {
+		t.Errorf("RequestBody got = %v", got)
+	}
+	if d.Response == nil || d.Response.StatusCode != 201 {
+		t.Fatalf("Response got = %v", d.Response)
+	}
+	if got := string(d.ResponseBody); got != "ok" {
+		t.Errorf("ResponseBody got = %v", got)
+	}
+	if dumps[1].Response != nil {
+		t.Errorf("Response without -resp file got = %v", dumps[1].Response)
+	}
+
+	entry := d.Entry()
+	if entry.ID != "1700000000000000000" || entry.Request.Method != "POST" || entry.Response.Status != 201 {
+		t.Errorf("Entry() got = %+v", entry)
+	}
+	if entry.Response.Content.Text != "ok" {
+		t.Errorf("Entry() content got = %v", entry.Response.Content.Text)
+	}
+}
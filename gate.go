@@ -0,0 +1,211 @@
+package hdproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultGateTimeout is used when GateConfig.Timeout is not set.
+const defaultGateTimeout = time.Minute
+
+// errNotHeld is returned by ReleaseHeld when there's no such request waiting at the gate.
+var errNotHeld = errors.New("request is not held")
+
+type (
+	// GateConfig holds matching requests before they're forwarded until released via admin API,
+	// so tests decide the order concurrent requests reach the target.
+	GateConfig struct {
+		Enabled bool
+		// Path is a regex matched against the request URI, every request when empty.
+		Path string
+		// Timeout forwards a held request anyway, default to 1m.
+		Timeout time.Duration
+	}
+
+	// requestGate are the requests held by the gate of a proxy, oldest first.
+	requestGate struct {
+		mutex sync.Mutex
+		held  []*heldRequest
+		// credits let the next requests pass without being held, see ReleaseNext
+		credits int
+	}
+
+	heldRequest struct {
+		id      int64
+		since   time.Time
+		method  string
+		uri     string
+		release chan struct{}
+	}
+
+	// adminGate is the JSON representation of the gate, also used to change it.
+	adminGate struct {
+		Enabled bool   `json:"enabled"`
+		Path    string `json:"path,omitempty"`
+		Timeout string `json:"timeout,omitempty"`
+		// Held & Credits are read only
+		Held    []adminHeld `json:"held"`
+		Credits int         `json:"credits"`
+	}
+
+	adminHeld struct {
+		ID     string    `json:"id"`
+		Since  time.Time `json:"since"`
+		Method string    `json:"method"`
+		URL    string    `json:"url"`
+	}
+)
+
+func (c GateConfig) validate(errs *ConfigErrors) {
+	if _, err := regexp.Compile(c.Path); err != nil {
+		errs.add("gate.path", "invalid regex %q: %v", c.Path, err)
+	}
+	if c.Timeout < 0 {
+		errs.add("gate.timeout", "must not be negative")
+	}
+}
+
+// compileGate returns the regex of requests to hold, nil when the gate is disabled.
+func compileGate(c GateConfig) (*regexp.Regexp, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	return regexp.Compile(c.Path)
+}
+
+func (s *proxySettings) gated(r *http.Request) bool {
+	return s.gate != nil && s.gate.MatchString(r.RequestURI)
+}
+
+// SetGate changes the gate, disabling it releases every held request.
+func (p *Proxy) SetGate(c GateConfig) error {
+	gate, err := compileGate(c)
+	if err != nil {
+		return fmt.Errorf("invalid gate path %q: %w", c.Path, err)
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.gate = gate
+		s.gateConfig = c
+	})
+	if gate == nil {
+		p.ReleaseAll()
+	}
+	return nil
+}
+
+// waitGate holds req until it's released, the gate times out or the client is gone, false in the last case.
+func (p *Proxy) waitGate(req *http.Request, ex *exchange) bool {
+	uri := p.redact.URI(req.RequestURI)
+	g := &p.gate
+	g.mutex.Lock()
+	if g.credits > 0 {
+		g.credits--
+		credits := g.credits
+		g.mutex.Unlock()
+		p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" passed, %d more to pass", req.Method, uri, credits))
+		return true
+	}
+	held := &heldRequest{id: ex.id, since: time.Now(), method: req.Method, uri: uri, release: make(chan struct{})}
+	g.held = append(g.held, held)
+	g.mutex.Unlock()
+
+	p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" held", req.Method, uri))
+	timeout := ex.settings.gateConfig.Timeout
+	if timeout == 0 {
+		timeout = defaultGateTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-held.release:
+		p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" released after %v", req.Method, uri, time.Since(held.since).Round(time.Millisecond)))
+	case <-timer.C:
+		g.remove(held)
+		p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" timed out after %v, forwarded", req.Method, uri, timeout))
+	case <-p.flights.drained():
+		g.remove(held)
+		p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" released by shutdown", req.Method, uri))
+	case <-req.Context().Done():
+		g.remove(held)
+		p.logEvent(req, ex, fmt.Sprintf("\"GATE %s %s\" client gone after %v, not forwarded", req.Method, uri, time.Since(ex.start).Round(time.Millisecond)))
+		return false
+	}
+	return true
+}
+
+func (g *requestGate) remove(held *heldRequest) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, h := range g.held {
+		if h == held {
+			g.held = append(g.held[:i], g.held[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReleaseHeld lets the held request id through.
+func (p *Proxy) ReleaseHeld(id int64) error {
+	g := &p.gate
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, h := range g.held {
+		if h.id == id {
+			g.held = append(g.held[:i], g.held[i+1:]...)
+			close(h.release)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d", errNotHeld, id)
+}
+
+// ReleaseNext lets the n oldest held requests through, what's left of n lets the next requests pass
+// without being held. It returns how many were released & how many may still pass.
+func (p *Proxy) ReleaseNext(n int) (released, credits int) {
+	g := &p.gate
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for released < n && len(g.held) > 0 {
+		close(g.held[0].release)
+		g.held = g.held[1:]
+		released++
+	}
+	g.credits += n - released
+	return released, g.credits
+}
+
+// ReleaseAll lets every held request through, the ones left to pass by ReleaseNext are dropped.
+func (p *Proxy) ReleaseAll() int {
+	g := &p.gate
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, h := range g.held {
+		close(h.release)
+	}
+	released := len(g.held)
+	g.held = nil
+	g.credits = 0
+	return released
+}
+
+// Gate returns the gate settings & the requests it holds, oldest first.
+func (p *Proxy) Gate() adminGate {
+	config := p.settings().gateConfig
+	result := adminGate{Enabled: config.Enabled, Path: config.Path, Held: []adminHeld{}}
+	if config.Timeout != 0 {
+		result.Timeout = config.Timeout.String()
+	}
+	g := &p.gate
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, h := range g.held {
+		result.Held = append(result.Held, adminHeld{ID: strconv.FormatInt(h.id, 10), Since: h.since, Method: h.method, URL: h.uri})
+	}
+	result.Credits = g.credits
+	return result
+}
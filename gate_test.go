@@ -0,0 +1,70 @@
+package hdproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxy_WaitGate(t *testing.T) {
+	settings := &proxySettings{gateConfig: GateConfig{Enabled: true, Timeout: 200 * time.Millisecond}}
+	settings.gate, _ = compileGate(settings.gateConfig)
+	p := &Proxy{logWriter: io.Discard, current: settings}
+
+	// wait starts n requests at the gate & returns the channel their ids are sent to once they pass
+	wait := func(ctx context.Context, ids ...int64) chan int64 {
+		passed := make(chan int64, len(ids))
+		for _, id := range ids {
+			ex := &exchange{id: id, settings: settings}
+			r := httptest.NewRequest(http.MethodGet, "/orders", nil).WithContext(ctx)
+			go func() {
+				p.waitGate(r, ex)
+				passed <- ex.id
+			}()
+			for held := p.Gate().Held; len(held) == 0 || held[len(held)-1].ID != strconv.FormatInt(id, 10); held = p.Gate().Held {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return passed
+	}
+
+	passed := wait(context.Background(), 1, 2, 3)
+	if released, credits := p.ReleaseNext(2); released != 2 || credits != 0 {
+		t.Errorf("ReleaseNext(2) got %d, %d, want 2, 0", released, credits)
+	}
+	if got := []int64{<-passed, <-passed}; got[0]+got[1] != 3 {
+		t.Errorf("released %v, want the oldest 1 & 2", got)
+	}
+	if err := p.ReleaseHeld(3); err != nil {
+		t.Fatal(err)
+	}
+	<-passed
+	if err := p.ReleaseHeld(3); !errors.Is(err, errNotHeld) {
+		t.Errorf("ReleaseHeld twice got %v, want errNotHeld", err)
+	}
+
+	// left over count lets the next requests through
+	if released, credits := p.ReleaseNext(1); released != 0 || credits != 1 {
+		t.Errorf("ReleaseNext(1) got %d, %d, want 0, 1", released, credits)
+	}
+	ex := &exchange{id: 4, settings: settings}
+	p.waitGate(httptest.NewRequest(http.MethodGet, "/orders", nil), ex)
+
+	start := time.Now()
+	p.waitGate(httptest.NewRequest(http.MethodGet, "/orders", nil), &exchange{id: 5, settings: settings})
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("timed out after %v, want 200ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	passed = wait(ctx, 6)
+	cancel()
+	if id := <-passed; id != 6 || len(p.Gate().Held) != 0 {
+		t.Errorf("client gone got %d, held %v", id, p.Gate().Held)
+	}
+}
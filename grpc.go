@@ -0,0 +1,402 @@
+package hdproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+// HAR content of gRPC exchanges, their messages decoded as JSON lines.
+const (
+	grpcHarMimeType = "application/json"
+	grpcHarComment  = "gRPC messages decoded as JSON, one per line"
+)
+
+// maxGRPCCapture is how much of each gRPC stream direction is kept for the dump files,
+// the stream itself is always forwarded in full.
+const maxGRPCCapture = 16 << 20
+
+type (
+	GRPCConfig struct {
+		// DescriptorSets are files from protoc --include_imports --descriptor_set_out=<file>.
+		DescriptorSets []string
+		// ProtoFiles are compiled with protoc found in PATH, ImportPaths are passed as its -I.
+		ProtoFiles  []string
+		ImportPaths []string
+	}
+
+	// GRPCDecoder turns length-prefixed gRPC messages into JSON, using the message types
+	// of the called method. Messages of unknown methods are written as base64.
+	GRPCDecoder struct {
+		files *protoregistry.Files
+	}
+
+	// captureBody keeps a copy of the stream passing through, done is called once the stream ends or is closed.
+	captureBody struct {
+		io.ReadCloser
+		done func()
+		once sync.Once
+
+		mutex     sync.Mutex
+		buf       bytes.Buffer
+		truncated bool
+	}
+
+	// grpcTransport sends gRPC calls over HTTP/2 whatever the upstream protocol, as gRPC requires it.
+	grpcTransport struct {
+		http.RoundTripper
+		h2 http.RoundTripper
+	}
+)
+
+func (c GRPCConfig) enabled() bool {
+	return len(c.DescriptorSets) > 0 || len(c.ProtoFiles) > 0
+}
+
+// NewGRPCDecoder loads the descriptors, nil decoder is returned when none is configured.
+func NewGRPCDecoder(config GRPCConfig) (*GRPCDecoder, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	fdSet := &descriptorpb.FileDescriptorSet{}
+	for _, fname := range config.DescriptorSets {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptorpb.FileDescriptorSet{}
+		if err = proto.Unmarshal(data, set); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set %s: %w", fname, err)
+		}
+		fdSet.File = append(fdSet.File, set.File...)
+	}
+	if len(config.ProtoFiles) > 0 {
+		set, err := compileProtoFiles(config.ProtoFiles, config.ImportPaths)
+		if err != nil {
+			return nil, err
+		}
+		fdSet.File = append(fdSet.File, set.File...)
+	}
+	files, err := protodesc.NewFiles(dedupFiles(fdSet))
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCDecoder{files: files}, nil
+}
+
+// dedupFiles drops files found more than once, e.g. common imports of several descriptor sets.
+func dedupFiles(fdSet *descriptorpb.FileDescriptorSet) *descriptorpb.FileDescriptorSet {
+	result := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, f := range fdSet.File {
+		if seen[f.GetName()] {
+			continue
+		}
+		seen[f.GetName()] = true
+		result.File = append(result.File, f)
+	}
+	return result
+}
+
+func compileProtoFiles(protoFiles []string, importPaths []string) (*descriptorpb.FileDescriptorSet, error) {
+	out, err := os.CreateTemp("", "hdproxy-*.pb")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	args := []string{"--include_imports", "--descriptor_set_out=" + out.Name()}
+	for _, path := range importPaths {
+		args = append(args, "-I", path)
+	}
+	args = append(args, protoFiles...)
+	var stderr bytes.Buffer
+	cmd := exec.Command("protoc", args...)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error compiling proto files with protoc, use DescriptorSets instead if protoc isn't available: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	result := &descriptorpb.FileDescriptorSet{}
+	return result, proto.Unmarshal(data, result)
+}
+
+// isGRPC reports whether r is a gRPC call, gRPC-Web is left as plain HTTP.
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// method finds the input & output message types of /package.Service/Method path.
+func (d *GRPCDecoder) method(path string) (input protoreflect.MessageDescriptor, output protoreflect.MessageDescriptor) {
+	if d == nil {
+		return nil, nil
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 {
+		return nil, nil
+	}
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(parts[len(parts)-2]))
+	if err != nil {
+		return nil, nil
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, nil
+	}
+	method := service.Methods().ByName(protoreflect.Name(parts[len(parts)-1]))
+	if method == nil {
+		return nil, nil
+	}
+	return method.Input(), method.Output()
+}
+
+// Decode writes every message in data as a line of JSON, msgType may be nil.
+// Compressed messages are decoded if encoding is gzip, redact is applied to each decoded message.
+func (d *GRPCDecoder) Decode(msgType protoreflect.MessageDescriptor, encoding string, data []byte, redact *Redactor) []byte {
+	return d.decode(msgType, encoding, data, redact, true)
+}
+
+// decode is Decode, messages that can't be decoded are left out unless raw, only their error is written.
+func (d *GRPCDecoder) decode(msgType protoreflect.MessageDescriptor, encoding string, data []byte, redact *Redactor, raw bool) []byte {
+	var result bytes.Buffer
+	for len(data) > 0 {
+		if len(data) < 5 {
+			writeUndecoded(&result, "_incomplete", data, "", raw)
+			break
+		}
+		compressed := data[0]&1 == 1
+		size := binary.BigEndian.Uint32(data[1:5])
+		if uint64(len(data)-5) < uint64(size) {
+			writeUndecoded(&result, "_incomplete", data, "", raw)
+			break
+		}
+		msg := data[5 : 5+size]
+		data = data[5+size:]
+		if compressed {
+			var err error
+			if msg, err = gunzipMessage(encoding, msg); err != nil {
+				writeUndecoded(&result, "_compressed", msg, err.Error(), raw)
+				continue
+			}
+		}
+		decoded, err := decodeMessage(msgType, msg)
+		if err != nil {
+			writeUndecoded(&result, "_raw", msg, err.Error(), raw)
+			continue
+		}
+		result.Write(redact.Body("application/json", decoded))
+		result.WriteByte('\n')
+	}
+	return result.Bytes()
+}
+
+// writeUndecoded writes a line for msg that couldn't be decoded, as base64 under key if raw.
+func writeUndecoded(w *bytes.Buffer, key string, msg []byte, errMsg string, raw bool) {
+	fields := make([]string, 0, 2)
+	switch {
+	case raw:
+		fields = append(fields, fmt.Sprintf("%q:%q", key, base64.StdEncoding.EncodeToString(msg)))
+	case len(errMsg) == 0:
+		fields = append(fields, fmt.Sprintf("%q:true", key))
+	}
+	if len(errMsg) > 0 {
+		fields = append(fields, fmt.Sprintf("\"_error\":%q", errMsg))
+	}
+	fmt.Fprintf(w, "{%s}\n", strings.Join(fields, ","))
+}
+
+func gunzipMessage(encoding string, msg []byte) ([]byte, error) {
+	if encoding != "gzip" {
+		return msg, fmt.Errorf("unsupported grpc-encoding %q", encoding)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return msg, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func decodeMessage(msgType protoreflect.MessageDescriptor, msg []byte) ([]byte, error) {
+	if msgType == nil {
+		return nil, fmt.Errorf("unknown message type")
+	}
+	m := dynamicpb.NewMessage(msgType)
+	if err := proto.Unmarshal(msg, m); err != nil {
+		return nil, err
+	}
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// protojson output is deliberately unstable, compact it so dump files are comparable
+	var compact bytes.Buffer
+	if err = json.Compact(&compact, data); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mutex.Lock()
+	if n > 0 && !c.truncated {
+		if c.buf.Len()+n > maxGRPCCapture {
+			c.truncated = true
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	c.mutex.Unlock()
+	if err == io.EOF && c.done != nil {
+		c.once.Do(c.done)
+	}
+	return n, err
+}
+
+// captured returns a copy of what's passed through so far, the stream may still be going on.
+func (c *captureBody) captured() ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte{}, c.buf.Bytes()...), c.truncated
+}
+
+func (c *captureBody) Close() error {
+	err := c.ReadCloser.Close()
+	if c.done != nil {
+		c.once.Do(c.done)
+	}
+	return err
+}
+
+// captureGRPCRequest starts capturing the request stream, the dump files are written by finishGRPC
+// once the response stream ends, as both are only complete by then.
+func (p *Proxy) captureGRPCRequest(ex *exchange, req *http.Request) {
+	dumpReq, _ := p.redact.Request(req, nil)
+	headReq := *dumpReq
+	headReq.Body = nil
+	head, err := httputil.DumpRequest(&headReq, false)
+	if err != nil {
+		fmt.Fprintln(p.logWriter, "error dumping grpc req", p.redact.URI(req.URL.String()), err)
+	}
+	ex.reqDump = head
+	capture := &captureBody{ReadCloser: req.Body}
+	if req.Body == nil || req.Body == http.NoBody {
+		capture.ReadCloser = http.NoBody
+	}
+	ex.grpcReq = capture
+	req.Body = capture
+}
+
+// captureGRPCResponse replaces the response body with one calling finishGRPC when it ends,
+// so streaming responses are forwarded as they come.
+func (p *Proxy) captureGRPCResponse(ex *exchange, resp *http.Response) {
+	capture := &captureBody{ReadCloser: resp.Body}
+	capture.done = func() {
+		p.finishGRPC(ex, resp, capture)
+	}
+	resp.Body = capture
+}
+
+func (p *Proxy) finishGRPC(ex *exchange, resp *http.Response, respCapture *captureBody) {
+	req := resp.Request
+	input, output := p.grpc.method(req.URL.Path)
+	var reqData []byte
+	var reqTruncated bool
+	if ex.grpcReq != nil {
+		reqData, reqTruncated = ex.grpcReq.captured()
+	}
+	respData, respTruncated := respCapture.captured()
+
+	reqJSON := p.grpc.Decode(input, req.Header.Get("Grpc-Encoding"), reqData, p.redact)
+	if reqTruncated {
+		reqJSON = append(reqJSON, "{\"_truncated\":true}\n"...)
+	}
+	respJSON := p.grpc.Decode(output, resp.Header.Get("Grpc-Encoding"), respData, p.redact)
+	if respTruncated {
+		respJSON = append(respJSON, "{\"_truncated\":true}\n"...)
+	}
+
+	if f := p.createDump(ex, "req"); f != nil {
+		dumpReq, _ := p.redact.Request(req, nil)
+		printReq(f, dumpReq)
+		f.Write(ex.reqDump)
+		f.Write(reqJSON)
+		f.Close()
+	}
+
+	// trailers carry grpc-status & grpc-message, chunked encoding is the way to dump them
+	redacted, _ := p.redact.Response(resp, nil)
+	dumpResp := *redacted
+	dumpResp.Body = io.NopCloser(bytes.NewReader(respJSON))
+	dumpResp.ContentLength = -1
+	dumpResp.TransferEncoding = []string{"chunked"}
+	dumpResp.Trailer = p.redact.Header(resp.Trailer)
+	respDump, err := httputil.DumpResponse(&dumpResp, true)
+	if err != nil {
+		fmt.Fprintln(p.logWriter, "error dumping grpc resp", p.redact.URI(req.URL.String()), err)
+		return
+	}
+	logResp(p.logWriter, &dumpResp, respDump, ex)
+	p.captureGRPCHar(ex, resp, reqData, respData, reqTruncated, respTruncated)
+	f := p.createDump(ex, "resp")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	printResp(f, &dumpResp)
+	f.Write(respDump)
+}
+
+// captureGRPCHar captures the messages as redacted JSON lines, like the dump files,
+// as raw protobuf is out of reach of redaction. Messages that can't be decoded are left out.
+func (p *Proxy) captureGRPCHar(ex *exchange, resp *http.Response, reqData, respData []byte, reqTruncated, respTruncated bool) {
+	input, output := p.grpc.method(resp.Request.URL.Path)
+	reqJSON := p.grpc.decode(input, resp.Request.Header.Get("Grpc-Encoding"), reqData, p.redact, false)
+	if reqTruncated {
+		reqJSON = append(reqJSON, "{\"_truncated\":true}\n"...)
+	}
+	respJSON := p.grpc.decode(output, resp.Header.Get("Grpc-Encoding"), respData, p.redact, false)
+	if respTruncated {
+		respJSON = append(respJSON, "{\"_truncated\":true}\n"...)
+	}
+	entry := p.harEntry(ex, resp, nil)
+	if len(reqJSON) > 0 {
+		entry.Request.PostData = &harlog.PostData{MimeType: grpcHarMimeType, Params: []*harlog.Param{}, Text: string(reqJSON), Comment: grpcHarComment}
+	}
+	entry.Request.BodySize = len(reqData)
+	entry.Response.Content = &harlog.Content{Size: int64(len(respJSON)), MimeType: grpcHarMimeType, Text: string(respJSON), Comment: grpcHarComment}
+	entry.Response.BodySize = int64(len(respData))
+	p.addHar(entry)
+}
+
+func (t grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isGRPC(req) {
+		return t.h2.RoundTrip(req)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
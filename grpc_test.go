@@ -0,0 +1,112 @@
+package hdproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testDescriptorSet writes a descriptor set of service test.Greeter with rpc Hello(Msg) returns (Msg).
+func testDescriptorSet(t *testing.T) string {
+	fdSet := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Msg"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1),
+					Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("password"), JsonName: proto.String("password"), Number: proto.Int32(2),
+					Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Hello"),
+				InputType:  proto.String(".test.Msg"),
+				OutputType: proto.String(".test.Msg"),
+			}},
+		}},
+	}}}
+	data, err := proto.Marshal(fdSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "test.pb")
+	if err = os.WriteFile(fname, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func grpcFrame(compressed bool, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestGRPCDecoder_Decode(t *testing.T) {
+	d, err := NewGRPCDecoder(GRPCConfig{DescriptorSets: []string{testDescriptorSet(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, output := d.method("/test.Greeter/Hello")
+	if input == nil || output == nil {
+		t.Fatal("method() not found")
+	}
+	if input, _ := d.method("/test.Greeter/Unknown"); input != nil {
+		t.Error("method() of unknown method got found")
+	}
+
+	msg := dynamicpb.NewMessage(input)
+	msg.Set(input.Fields().ByName("name"), protoreflect.ValueOfString("bob"))
+	msg.Set(input.Fields().ByName("password"), protoreflect.ValueOfString("secret"))
+	encoded, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(encoded)
+	zw.Close()
+
+	data := append(grpcFrame(false, encoded), grpcFrame(true, zipped.Bytes())...)
+	data = append(data, 0, 0, 0)
+	redact, _ := NewRedactor(RedactConfig{JSON: []string{"password"}})
+	got := string(d.Decode(input, "gzip", data, redact))
+	want := `{"name":"bob","password":"REDACTED"}
+{"name":"bob","password":"REDACTED"}
+{"_incomplete":"AAAA"}
+`
+	if got != want {
+		t.Errorf("Decode() got = %v, want %v", got, want)
+	}
+
+	// without descriptor, messages are kept as base64
+	var nilDecoder *GRPCDecoder
+	got = string(nilDecoder.Decode(nil, "", grpcFrame(false, []byte("hi")), nil))
+	want = `{"_raw":"aGk=","_error":"unknown message type"}` + "\n"
+	if got != want {
+		t.Errorf("Decode() without descriptor got = %v, want %v", got, want)
+	}
+
+	// captured for HAR, messages that can't be decoded are left out
+	got = string(nilDecoder.decode(nil, "", append(grpcFrame(false, []byte("hi")), 0, 0), nil, false))
+	want = `{"_error":"unknown message type"}` + "\n" + `{"_incomplete":true}` + "\n"
+	if got != want {
+		t.Errorf("decode() without raw got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package hdproxy
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+const defaultHarSize = 1000
+
+type (
+	// HarCapture keeps the latest captured exchanges as HAR entries.
+	HarCapture struct {
+		mutex   sync.Mutex
+		size    int
+		next    int
+		entries []*harlog.Entry
+	}
+)
+
+func NewHarCapture(size int) *HarCapture {
+	return &HarCapture{size: size}
+}
+
+// Add stores e, dropping the oldest entry when the capture is full.
+func (h *HarCapture) Add(e *harlog.Entry) {
+	if h == nil || h.size <= 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % h.size
+}
+
+// Entries returns the stored entries, oldest first.
+func (h *HarCapture) Entries() []*harlog.Entry {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	result := make([]*harlog.Entry, 0, len(h.entries))
+	result = append(result, h.entries[h.next:]...)
+	result = append(result, h.entries[:h.next]...)
+	return result
+}
+
+// HAR wraps entries into a HAR 1.2 container.
+func HAR(entries []*harlog.Entry) *harlog.HARContainer {
+	if entries == nil {
+		entries = make([]*harlog.Entry, 0)
+	}
+	return &harlog.HARContainer{
+		Log: &harlog.Log{
+			Version: "1.2",
+			Creator: &harlog.Creator{
+				Name:    "hdproxy",
+				Version: "0.0.1",
+			},
+			Entries: entries,
+		},
+	}
+}
+
+// WriteFile writes the stored entries as HAR file fname.
+func (h *HarCapture) WriteFile(fname string) error {
+	return writeHarFile(fname, h.Entries())
+}
+
+func writeHarFile(fname string, entries []*harlog.Entry) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(HAR(entries))
+}
@@ -0,0 +1,155 @@
+package harlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NewRequest builds HAR request data from r, using body as the posted data.
+// Unlike Transport, it doesn't consume r.Body, so it can be used on server side requests.
+func NewRequest(r *http.Request, body []byte) *Request {
+	bodySize := len(body)
+	var postData *PostData
+	if len(body) > 0 {
+		mimeType := r.Header.Get("Content-Type")
+		postData = &PostData{
+			MimeType: mimeType,
+			Params:   []*Param{},
+			Text:     string(body),
+		}
+
+		mediaType, params, _ := mime.ParseMediaType(mimeType)
+		switch mediaType {
+		case "application/x-www-form-urlencoded":
+			values, err := url.ParseQuery(string(body))
+			if err == nil {
+				for k, v := range values {
+					for _, s := range v {
+						postData.Params = append(postData.Params, &Param{
+							Name:  k,
+							Value: s,
+						})
+					}
+				}
+			}
+
+		case "multipart/form-data":
+			form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(10 * 1024 * 1024)
+			if err == nil {
+				for k, v := range form.Value {
+					for _, s := range v {
+						postData.Params = append(postData.Params, &Param{
+							Name:  k,
+							Value: s,
+						})
+					}
+				}
+				for k, v := range form.File {
+					for _, s := range v {
+						postData.Params = append(postData.Params, &Param{
+							Name:        k,
+							FileName:    s.Filename,
+							ContentType: s.Header.Get("Content-Type"),
+						})
+					}
+				}
+				_ = form.RemoveAll()
+			}
+		}
+	}
+
+	return &Request{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     toHARCookies(r.Cookies()),
+		Headers:     toHARNVP(r.Header),
+		QueryString: toHARNVP(r.URL.Query()),
+		PostData:    postData,
+		HeadersSize: -1, // TODO
+		BodySize:    bodySize,
+	}
+}
+
+// NewResponse builds HAR response data from resp, using body as the content.
+// Textual content is kept as is, anything else is base64 encoded.
+func NewResponse(resp *http.Response, body []byte) *Response {
+	mimeType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	var text string
+	var encoding string
+	switch {
+	case isTextual(mediaType):
+		text = string(body)
+	case len(body) > 0:
+		text = base64.StdEncoding.EncodeToString(body)
+		encoding = "base64"
+	}
+
+	return &Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     toHARCookies(resp.Cookies()),
+		Headers:     toHARNVP(resp.Header),
+		Content: &Content{
+			Size:        int64(len(body)),
+			Compression: 0,
+			MimeType:    mimeType,
+			Text:        text,
+			Encoding:    encoding,
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+}
+
+func isTextual(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+func toHARCookies(cookies []*http.Cookie) []*Cookie {
+	harCookies := make([]*Cookie, 0, len(cookies))
+
+	for _, cookie := range cookies {
+		harCookies = append(harCookies, &Cookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			Expires:  Time(cookie.Expires),
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		})
+	}
+
+	return harCookies
+}
+
+func toHARNVP(vs map[string][]string) []*NVP {
+	nvps := make([]*NVP, 0, len(vs))
+
+	for k, v := range vs {
+		for _, s := range v {
+			nvps = append(nvps, &NVP{
+				Name:  k,
+				Value: s,
+			})
+		}
+	}
+
+	return nvps
+}
@@ -204,9 +204,9 @@ func (h *Transport) preRoundTrip(r *http.Request, entry *Entry) error {
 		Method:      r.Method,
 		URL:         r.URL.String(),
 		HTTPVersion: r.Proto,
-		Cookies:     h.toHARCookies(r.Cookies()),
-		Headers:     h.toHARNVP(r.Header),
-		QueryString: h.toHARNVP(r.URL.Query()),
+		Cookies:     toHARCookies(r.Cookies()),
+		Headers:     toHARNVP(r.Header),
+		QueryString: toHARNVP(r.URL.Query()),
 		PostData:    postData,
 		HeadersSize: -1, // TODO
 		BodySize:    bodySize,
@@ -250,8 +250,8 @@ func (h *Transport) postRoundTrip(r *http.Request, resp *http.Response, entry *E
 		Status:      resp.StatusCode,
 		StatusText:  "",
 		HTTPVersion: resp.Proto,
-		Cookies:     h.toHARCookies(resp.Cookies()),
-		Headers:     h.toHARNVP(resp.Header),
+		Cookies:     toHARCookies(resp.Cookies()),
+		Headers:     toHARNVP(resp.Header),
 		Content: &Content{
 			Size:        resp.ContentLength, // TODO 圧縮されている場合のフォロー
 			Compression: 0,
@@ -266,36 +266,3 @@ func (h *Transport) postRoundTrip(r *http.Request, resp *http.Response, entry *E
 
 	return nil
 }
-
-func (h *Transport) toHARCookies(cookies []*http.Cookie) []*Cookie {
-	harCookies := make([]*Cookie, 0, len(cookies))
-
-	for _, cookie := range cookies {
-		harCookies = append(harCookies, &Cookie{
-			Name:     cookie.Name,
-			Value:    cookie.Value,
-			Path:     cookie.Path,
-			Domain:   cookie.Domain,
-			Expires:  Time(cookie.Expires),
-			HTTPOnly: cookie.HttpOnly,
-			Secure:   cookie.Secure,
-		})
-	}
-
-	return harCookies
-}
-
-func (h *Transport) toHARNVP(vs map[string][]string) []*NVP {
-	nvps := make([]*NVP, 0, len(vs))
-
-	for k, v := range vs {
-		for _, s := range v {
-			nvps = append(nvps, &NVP{
-				Name:  k,
-				Value: s,
-			})
-		}
-	}
-
-	return nvps
-}
@@ -162,6 +162,8 @@ type Entry struct {
 	Connection string `json:"connection,omitempty"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field, unique ID of the entry within the log, e.g. hdproxy dump file name.
+	ID string `json:"_id,omitempty"`
 }
 
 // Request is ...
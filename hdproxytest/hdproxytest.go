@@ -0,0 +1,391 @@
+// Package hdproxytest runs an hdproxy in front of a test target, recording exchanges in memory
+// so tests can assert on what went through it, and injecting delays & faults into the target.
+//
+//	s := hdproxytest.New(t, ordersHandler)
+//	client.BaseURL = s.URL
+//	...
+//	s.ExpectOne(hdproxytest.Match{Method: "POST", Path: "/orders", JSON: map[string]interface{}{"x": 1}})
+package hdproxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siroj100/hdproxy"
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+type (
+	// Server is a proxy listening on URL, forwarding to Target & recording every exchange.
+	Server struct {
+		// URL of the proxy, to be used by the code under test instead of Target's.
+		URL    string
+		Proxy  *hdproxy.Proxy
+		Target *httptest.Server
+
+		t      testing.TB
+		srv    *httptest.Server
+		mutex  sync.Mutex
+		faults []*Fault
+		// entries are the recorded exchanges, captured is closed & replaced whenever one is added
+		entries  []*harlog.Entry
+		captured chan struct{}
+	}
+
+	// Match selects exchanges, empty fields match anything.
+	Match struct {
+		Method string
+		// Path of the request as sent to the proxy, exact. The path of the proxy target is stripped,
+		// so "/users" matches upstream "/api/users" when the target is http://host/api.
+		Path string
+		// Headers the request must have, exact value or any value when empty.
+		Headers map[string]string
+		// JSON fields the request body must have, by dotted path with numbers for array index, e.g. "items.0.sku".
+		// Values are compared as JSON, nil matches any value.
+		JSON map[string]interface{}
+		// Status of the response, never matched by faults as they're applied before there's one.
+		Status int
+	}
+
+	// Fault changes how the target handles matching requests.
+	Fault struct {
+		Match Match
+		// Delay before the target gets the request, e.g. to hit the proxy timeouts.
+		Delay time.Duration
+		// Status & Body answer the request instead of the target, when Status is set.
+		Status int
+		Body   string
+		// Times is how many requests the fault applies to, 0 for all.
+		Times int
+	}
+)
+
+// New starts target & a proxy in front of it, both closed when the test ends.
+// opts are applied before the target & recording, e.g. hdproxy.WithLogWriter to see the access log.
+func New(t testing.TB, target http.Handler, opts ...hdproxy.Option) *Server {
+	t.Helper()
+	s := &Server{t: t, captured: make(chan struct{})}
+	s.Target = httptest.NewServer(s.inject(target))
+	opts = append(opts, hdproxy.WithTarget(s.Target.URL), hdproxy.WithSink(s))
+	p, err := hdproxy.New(opts...)
+	if err != nil {
+		s.Target.Close()
+		t.Fatalf("hdproxytest: %v", err)
+	}
+	s.Proxy = p
+	s.srv = httptest.NewServer(p)
+	s.URL = s.srv.URL
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close shuts the proxy & the target down.
+func (s *Server) Close() {
+	s.srv.Close()
+	s.Target.Close()
+}
+
+// Capture records e, it's the sink of the proxy.
+func (s *Server) Capture(e *harlog.Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = append(s.entries, e)
+	close(s.captured)
+	s.captured = make(chan struct{})
+}
+
+// Inject adds f, the first matching fault applies.
+func (s *Server) Inject(f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Reset forgets the recorded exchanges & injected faults.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = nil
+	s.faults = nil
+}
+
+// Entries returns the recorded exchanges, in the order their responses came.
+func (s *Server) Entries() []*harlog.Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*harlog.Entry{}, s.entries...)
+}
+
+// Find returns the recorded exchanges matching m.
+func (s *Server) Find(m Match) []*harlog.Entry {
+	var result []*harlog.Entry
+	for _, e := range s.Entries() {
+		if m.matches(e, s.basePath()) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// ExpectCount reports an error when the number of exchanges matching m is not n, it returns those found.
+func (s *Server) ExpectCount(m Match, n int) []*harlog.Entry {
+	s.t.Helper()
+	found := s.Find(m)
+	if len(found) != n {
+		s.t.Errorf("hdproxytest: expected %d %s, got %d of\n%s", n, m, len(found), s.recorded())
+	}
+	return found
+}
+
+// ExpectOne reports an error unless exactly one exchange matches m, it returns that one or nil.
+func (s *Server) ExpectOne(m Match) *harlog.Entry {
+	s.t.Helper()
+	if found := s.ExpectCount(m, 1); len(found) == 1 {
+		return found[0]
+	}
+	return nil
+}
+
+// WaitFor waits up to timeout for an exchange matching m, e.g. one sent in the background by the code under test.
+// It returns the first one, or fails the test when there's none. Like t.Fatal, it must be called from the test goroutine.
+func (s *Server) WaitFor(m Match, timeout time.Duration) *harlog.Entry {
+	s.t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mutex.Lock()
+		captured := s.captured
+		s.mutex.Unlock()
+		if found := s.Find(m); len(found) > 0 {
+			return found[0]
+		}
+		select {
+		case <-captured:
+		case <-timer.C:
+			s.t.Fatalf("hdproxytest: no %s within %v, got\n%s", m, timeout, s.recorded())
+			return nil
+		}
+	}
+}
+
+// recorded lists the recorded exchanges for failure messages.
+func (s *Server) recorded() string {
+	entries := s.Entries()
+	if len(entries) == 0 {
+		return "  nothing"
+	}
+	basePath := s.basePath()
+	var sb strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&sb, "  %s %s", e.Request.Method, requestPath(e.Request, basePath))
+		if e.Response != nil {
+			fmt.Fprintf(&sb, " %d", e.Response.Status)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// inject wraps target so the faults apply.
+func (s *Server) inject(target http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		f := s.fault(&harlog.Entry{Request: harlog.NewRequest(r, body)})
+		if f == nil {
+			target.ServeHTTP(w, r)
+			return
+		}
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.Status == 0 {
+			target.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(f.Status)
+		io.WriteString(w, f.Body)
+	})
+}
+
+// fault returns a copy of the first fault matching e & counts it, nil when none applies.
+func (s *Server) fault(e *harlog.Entry) *Fault {
+	basePath := s.basePath()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, f := range s.faults {
+		if !f.Match.matches(e, basePath) {
+			continue
+		}
+		result := *f
+		if f.Times == 1 {
+			s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+		} else if f.Times > 1 {
+			f.Times--
+		}
+		return &result
+	}
+	return nil
+}
+
+// matches reports whether e matches m, basePath is the target path stripped from the request path.
+func (m Match) matches(e *harlog.Entry, basePath string) bool {
+	req := e.Request
+	if len(m.Method) > 0 && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if len(m.Path) > 0 && m.Path != requestPath(req, basePath) {
+		return false
+	}
+	for name, value := range m.Headers {
+		if !hasHeader(req.Headers, name, value) {
+			return false
+		}
+	}
+	if len(m.JSON) > 0 && !m.matchJSON(req) {
+		return false
+	}
+	if m.Status > 0 && (e.Response == nil || e.Response.Status != m.Status) {
+		return false
+	}
+	return true
+}
+
+func (m Match) matchJSON(req *harlog.Request) bool {
+	if req.PostData == nil {
+		return false
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(req.PostData.Text), &doc); err != nil {
+		return false
+	}
+	for path, want := range m.JSON {
+		got, found := lookupJSON(doc, strings.Split(path, "."))
+		if !found {
+			return false
+		}
+		if want != nil && !equalJSON(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes m for failure messages, e.g. "POST /orders with JSON x=1".
+func (m Match) String() string {
+	parts := []string{"request"}
+	if len(m.Method) > 0 || len(m.Path) > 0 {
+		parts = []string{strings.TrimSpace(strings.ToUpper(m.Method) + " " + m.Path)}
+	}
+	if len(m.Headers) > 0 {
+		pairs := make([]string, 0, len(m.Headers))
+		for name, value := range m.Headers {
+			if len(value) > 0 {
+				name += "=" + value
+			}
+			pairs = append(pairs, name)
+		}
+		sort.Strings(pairs)
+		parts = append(parts, "with headers "+strings.Join(pairs, ", "))
+	}
+	if len(m.JSON) > 0 {
+		pairs := make([]string, 0, len(m.JSON))
+		for path, value := range m.JSON {
+			if value != nil {
+				raw, _ := json.Marshal(value)
+				path += "=" + string(raw)
+			}
+			pairs = append(pairs, path)
+		}
+		sort.Strings(pairs)
+		parts = append(parts, "with JSON "+strings.Join(pairs, ", "))
+	}
+	if m.Status > 0 {
+		parts = append(parts, "answered "+strconv.Itoa(m.Status))
+	}
+	return strings.Join(parts, " ")
+}
+
+// basePath is the path of the current proxy target, the proxy prepends it to every request path.
+func (s *Server) basePath() string {
+	u, err := url.Parse(s.Proxy.Config().Target)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// requestPath returns the path of req as sent to the proxy, without basePath.
+func requestPath(req *harlog.Request, basePath string) string {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return req.URL
+	}
+	if path := strings.TrimPrefix(u.Path, basePath); len(path) < len(u.Path) && (len(path) == 0 || path[0] == '/') {
+		return path
+	}
+	return u.Path
+}
+
+func hasHeader(headers []*harlog.NVP, name, value string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) && (len(value) == 0 || h.Value == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJSON returns the value at path in doc, keys for objects & indexes for arrays.
+func lookupJSON(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			child, found := v[key]
+			if !found {
+				return nil, false
+			}
+			doc = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// equalJSON compares got, decoded JSON, with want, any value, by their JSON encoding.
+func equalJSON(got, want interface{}) bool {
+	rawWant, err := json.Marshal(want)
+	if err != nil {
+		return false
+	}
+	var normalized interface{}
+	if err = json.Unmarshal(rawWant, &normalized); err != nil {
+		return false
+	}
+	rawGot, _ := json.Marshal(got)
+	rawWant, _ = json.Marshal(normalized)
+	return bytes.Equal(rawGot, rawWant)
+}
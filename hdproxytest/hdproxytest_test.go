@@ -0,0 +1,133 @@
+package hdproxytest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siroj100/hdproxy"
+)
+
+// recorder is a testing.TB keeping failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+func orders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, `{"id":1}`)
+}
+
+func post(t *testing.T, url, body string) int {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServer_Expect(t *testing.T) {
+	s := New(t, http.HandlerFunc(orders))
+	post(t, s.URL+"/orders", `{"x":1,"items":[{"sku":"a"}]}`)
+	post(t, s.URL+"/orders", `{"y":2}`)
+
+	if e := s.ExpectOne(Match{Method: "POST", Path: "/orders", JSON: map[string]interface{}{"x": 1}}); e == nil || e.Response.Status != http.StatusCreated {
+		t.Errorf("ExpectOne got %+v", e)
+	}
+	s.ExpectCount(Match{Path: "/orders", Headers: map[string]string{"content-type": "application/json"}, Status: http.StatusCreated}, 2)
+	s.ExpectOne(Match{JSON: map[string]interface{}{"items.0.sku": "a", "x": nil}})
+
+	r := &recorder{TB: t}
+	s.t = r
+	s.ExpectOne(Match{Method: "POST", Path: "/orders", JSON: map[string]interface{}{"x": 2}})
+	s.ExpectCount(Match{Path: "/order"}, 1)
+	s.WaitFor(Match{Method: "DELETE"}, 10*time.Millisecond)
+	want := []string{
+		"hdproxytest: expected 1 POST /orders with JSON x=2, got 0 of\n  POST /orders 201\n  POST /orders 201",
+		"hdproxytest: expected 1 /order, got 0 of\n  POST /orders 201\n  POST /orders 201",
+		"hdproxytest: no DELETE within 10ms, got\n  POST /orders 201\n  POST /orders 201",
+	}
+	if fmt.Sprint(r.failures) != fmt.Sprint(want) {
+		t.Errorf("failures got %q, want %q", r.failures, want)
+	}
+}
+
+func TestServer_WaitFor(t *testing.T) {
+	s := New(t, http.HandlerFunc(orders))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		http.Get(s.URL + "/later")
+	}()
+	if e := s.WaitFor(Match{Method: "GET", Path: "/later"}, time.Second); e == nil {
+		t.Error("WaitFor got nothing")
+	}
+	s.Reset()
+	if entries := s.Entries(); len(entries) != 0 {
+		t.Errorf("Reset kept %d entries", len(entries))
+	}
+}
+
+func TestServer_Inject(t *testing.T) {
+	s := New(t, http.HandlerFunc(orders), hdproxy.WithConfig(hdproxy.ProxyConfig{
+		Timeouts: hdproxy.TimeoutsConfig{ResponseHeader: 50 * time.Millisecond},
+	}))
+	s.Inject(Fault{Match: Match{Path: "/orders", JSON: map[string]interface{}{"x": 1}}, Status: http.StatusServiceUnavailable, Body: "down", Times: 1})
+	s.Inject(Fault{Match: Match{Path: "/slow"}, Delay: 200 * time.Millisecond})
+
+	tests := []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/orders", `{"x":1}`, http.StatusServiceUnavailable},
+		{"/orders", `{"x":1}`, http.StatusCreated},
+		{"/orders", `{"x":2}`, http.StatusCreated},
+		{"/slow", `{}`, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		if got := post(t, s.URL+tt.path, tt.body); got != tt.want {
+			t.Errorf("POST %s %s got %d, want %d", tt.path, tt.body, got, tt.want)
+		}
+	}
+	if e := s.ExpectOne(Match{Status: http.StatusServiceUnavailable}); e == nil || e.Response.Content.Text != "down" {
+		t.Errorf("fault response got %+v", e)
+	}
+}
+
+func TestServer_TargetPath(t *testing.T) {
+	var upstream string
+	s := New(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.URL.Path
+		orders(w, r)
+	}))
+	if err := s.Proxy.SetTarget(s.Target.URL + "/api"); err != nil {
+		t.Fatal(err)
+	}
+	s.Inject(Fault{Match: Match{Path: "/users"}, Status: http.StatusServiceUnavailable, Times: 1})
+
+	if got := post(t, s.URL+"/users", `{}`); got != http.StatusServiceUnavailable {
+		t.Errorf("POST /users got %d, want fault %d", got, http.StatusServiceUnavailable)
+	}
+	if got := post(t, s.URL+"/users", `{}`); got != http.StatusCreated || upstream != "/api/users" {
+		t.Errorf("POST /users got %d to %q, want %d to /api/users", got, upstream, http.StatusCreated)
+	}
+	s.ExpectCount(Match{Method: "POST", Path: "/users"}, 2)
+	s.ExpectCount(Match{Path: "/api/users"}, 0)
+}
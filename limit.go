@@ -0,0 +1,240 @@
+package hdproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys of RateLimitConfig.Key, besides "header:<name>".
+const (
+	limitByIP     = "ip"
+	limitByRoute  = "route"
+	limitByHeader = "header:"
+)
+
+// maxBuckets is how many keys a rate limit tracks before refilled buckets are dropped.
+const maxBuckets = 10000
+
+type (
+	// RateLimitConfig is a token bucket per key, requests over it get 429 with Retry-After.
+	RateLimitConfig struct {
+		// Path is a regex matched against the request URI, every request when empty.
+		Path string
+		// Rate is how many requests per second, Burst how many at once, default to Rate rounded up.
+		Rate  float64
+		Burst int
+		// Key is what gets its own bucket: "ip" (default), "route" for method & path,
+		// or "header:<name>" e.g. "header:X-Api-Key".
+		Key string
+	}
+
+	// ConcurrencyConfig caps the requests in flight, excess ones wait in queue or get 503.
+	ConcurrencyConfig struct {
+		// Max requests in flight, unlimited when 0.
+		Max int
+		// QueueTimeout is how long excess requests wait for their turn, rejected right away when 0.
+		QueueTimeout time.Duration
+	}
+
+	rateLimit struct {
+		path   *regexp.Regexp
+		rate   float64
+		burst  float64
+		key    string
+		header string
+
+		mutex   sync.Mutex
+		buckets map[string]*tokenBucket
+	}
+
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	// concurrencyLimit is a semaphore, nil when unlimited.
+	concurrencyLimit struct {
+		slots        chan struct{}
+		queueTimeout time.Duration
+	}
+)
+
+func (c RateLimitConfig) validate(key string, errs *ConfigErrors) {
+	if _, err := regexp.Compile(c.Path); err != nil {
+		errs.add(key+".path", "invalid regex %q: %v", c.Path, err)
+	}
+	if c.Rate <= 0 {
+		errs.add(key+".rate", "must be positive")
+	}
+	if c.Burst < 0 {
+		errs.add(key+".burst", "must not be negative")
+	}
+	switch k := strings.ToLower(c.Key); {
+	case k == "", k == limitByIP, k == limitByRoute:
+	case strings.HasPrefix(k, limitByHeader) && len(k) > len(limitByHeader):
+	default:
+		errs.add(key+".key", "invalid key %q, expecting ip, route or header:<name>", c.Key)
+	}
+}
+
+func validateLimits(c ProxyConfig, errs *ConfigErrors) {
+	for i, limit := range c.RateLimits {
+		limit.validate("ratelimits."+strconv.Itoa(i), errs)
+	}
+	if c.Concurrency.Max < 0 {
+		errs.add("concurrency.max", "must not be negative")
+	}
+	if c.Concurrency.QueueTimeout < 0 {
+		errs.add("concurrency.queuetimeout", "must not be negative")
+	}
+}
+
+func newRateLimits(configs []RateLimitConfig) ([]*rateLimit, error) {
+	result := make([]*rateLimit, 0, len(configs))
+	for _, config := range configs {
+		rx, err := regexp.Compile(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		burst := float64(config.Burst)
+		if burst == 0 {
+			burst = math.Ceil(config.Rate)
+		}
+		limit := &rateLimit{path: rx, rate: config.Rate, burst: burst, key: strings.ToLower(config.Key), buckets: make(map[string]*tokenBucket)}
+		if strings.HasPrefix(limit.key, limitByHeader) {
+			limit.header = config.Key[len(limitByHeader):]
+			limit.key = limitByHeader
+		}
+		result = append(result, limit)
+	}
+	return result, nil
+}
+
+// keyOf returns the bucket key of r from client IP, false if the limit doesn't apply to r.
+func (l *rateLimit) keyOf(r *http.Request, client string) (string, bool) {
+	if !l.path.MatchString(r.RequestURI) {
+		return "", false
+	}
+	switch l.key {
+	case limitByRoute:
+		return r.Method + " " + r.URL.Path, true
+	case limitByHeader:
+		return r.Header.Get(l.header), true
+	default:
+		return client, true
+	}
+}
+
+// describe returns key as logged, header values are hashed since they are usually credentials.
+func (l *rateLimit) describe(key string, redact *Redactor) string {
+	if l.key == limitByHeader {
+		return limitByHeader + l.header + " " + redact.hash(key)
+	}
+	return redact.String(key)
+}
+
+// allow takes a token from the bucket of key, or returns how long until one is available.
+func (l *rateLimit) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops buckets that are full again, same as new ones.
+func (l *rateLimit) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func newConcurrencyLimit(config ConcurrencyConfig) *concurrencyLimit {
+	if config.Max == 0 {
+		return nil
+	}
+	return &concurrencyLimit{slots: make(chan struct{}, config.Max), queueTimeout: config.QueueTimeout}
+}
+
+// acquire takes a slot, waiting up to the queue timeout or until r is cancelled. release must be called once done.
+func (c *concurrencyLimit) acquire(r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if c.queueTimeout == 0 {
+		return false
+	}
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (c *concurrencyLimit) release() {
+	if c != nil {
+		<-c.slots
+	}
+}
+
+// limit applies rate limits & concurrency cap to r, answering it when rejected.
+// It returns false when r is rejected, release must be called otherwise.
+func (p *Proxy) limit(w http.ResponseWriter, r *http.Request, client string) bool {
+	now := time.Now()
+	for _, l := range p.rateLimits {
+		key, ok := l.keyOf(r, client)
+		if !ok {
+			continue
+		}
+		if allowed, wait := l.allow(key, now); !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			p.logRejected(r, http.StatusTooManyRequests, fmt.Sprintf("rate limited %s, retry after %ds", l.describe(key, p.redact), retryAfter))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return false
+		}
+	}
+	if !p.concurrency.acquire(r) {
+		p.logRejected(r, http.StatusServiceUnavailable, "too many concurrent requests")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// logRejected writes the access log of r rejected by the proxy itself.
+func (p *Proxy) logRejected(r *http.Request, status int, reason string) {
+	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
+	fmt.Fprintf(p.logWriter, "%s - - [%s] \"%s %s %s\" %d %s\n", r.RemoteAddr, reqDate, r.Method, p.redact.URI(r.RequestURI), r.Proto, status, reason)
+}
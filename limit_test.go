@@ -0,0 +1,116 @@
+package hdproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit_Allow(t *testing.T) {
+	limits, err := newRateLimits([]RateLimitConfig{{Rate: 2, Burst: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limits[0]
+	now := time.Now()
+	tests := []struct {
+		name      string
+		key       string
+		after     time.Duration
+		wantAllow bool
+		wantWait  time.Duration
+	}{
+		{"burst 1", "a", 0, true, 0},
+		{"burst 2", "a", 0, true, 0},
+		{"empty", "a", 0, false, 500 * time.Millisecond},
+		{"other key", "b", 0, true, 0},
+		{"half refilled", "a", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled", "a", 500 * time.Millisecond, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, wait := l.allow(tt.key, now.Add(tt.after))
+			if allowed != tt.wantAllow || wait != tt.wantWait {
+				t.Errorf("allow = %v, %v, want %v, %v", allowed, wait, tt.wantAllow, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestRateLimit_KeyOf(t *testing.T) {
+	tests := []struct {
+		config RateLimitConfig
+		want   string
+		wantOk bool
+	}{
+		{RateLimitConfig{}, "10.0.0.1", true},
+		{RateLimitConfig{Key: "route"}, "GET /users/1", true},
+		{RateLimitConfig{Key: "header:X-Api-Key"}, "secret", true},
+		{RateLimitConfig{Path: "^/orders"}, "", false},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/users/1?q=x", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	for _, tt := range tests {
+		limits, err := newRateLimits([]RateLimitConfig{tt.config})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := limits[0].keyOf(r, "10.0.0.1")
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("%+v: keyOf = %q, %v, want %q, %v", tt.config, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestRateLimit_Describe(t *testing.T) {
+	limits, err := newRateLimits([]RateLimitConfig{{Rate: 1}, {Rate: 1, Key: "header:X-Api-Key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := limits[0].describe("10.0.0.1", nil); got != "10.0.0.1" {
+		t.Errorf("ip describe = %q", got)
+	}
+	masked, err := NewRedactor(RedactConfig{Headers: []string{"X-Api-Key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, redact := range []*Redactor{nil, masked} {
+		got := limits[1].describe("secret", redact)
+		if strings.Contains(got, "secret") || !strings.HasPrefix(got, "header:X-Api-Key hmac:") {
+			t.Errorf("header describe = %q, want hashed value", got)
+		}
+	}
+}
+
+func TestConcurrencyLimit_Acquire(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	reject := newConcurrencyLimit(ConcurrencyConfig{Max: 1})
+	if !reject.acquire(r) {
+		t.Fatal("first acquire failed")
+	}
+	if reject.acquire(r) {
+		t.Error("second acquire succeeded without queue")
+	}
+
+	queue := newConcurrencyLimit(ConcurrencyConfig{Max: 1, QueueTimeout: time.Second})
+	queue.acquire(r)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.release()
+	}()
+	if !queue.acquire(r) {
+		t.Error("queued acquire failed after release")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if queue.acquire(r.WithContext(ctx)) {
+		t.Error("acquire succeeded for cancelled request")
+	}
+	if newConcurrencyLimit(ConcurrencyConfig{}) != nil {
+		t.Error("unlimited is not nil")
+	}
+}
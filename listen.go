@@ -0,0 +1,98 @@
+package hdproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks Listen as a Unix domain socket path, e.g. "unix:/run/hdproxy.sock".
+const unixPrefix = "unix:"
+
+// listenAddress resolves Listen & Port of a proxy into network & address for net.Listen.
+// Listen is empty for every interface, an IP (IPv6 optionally in brackets), a host name,
+// a network interface name like "lo" or "eth0", or unix:<path>.
+func listenAddress(listen string, port int) (network string, address string, err error) {
+	listen = strings.TrimSpace(listen)
+	if strings.HasPrefix(listen, unixPrefix) {
+		path := strings.TrimPrefix(listen, unixPrefix)
+		if len(path) == 0 {
+			return "", "", errors.New("unix socket path is required")
+		}
+		return "unix", path, nil
+	}
+	host := listen
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return "", "", fmt.Errorf("invalid listen address %q", listen)
+		}
+		host = host[1 : len(host)-1]
+	}
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		if strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("invalid listen address %q, expecting host or interface without port, port is set by Port", listen)
+		}
+		if iface, err := net.InterfaceByName(host); err == nil {
+			if host, err = interfaceIP(iface); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// interfaceIP returns the first address of iface, IPv4 preferred.
+func interfaceIP(iface *net.Interface) (string, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("error reading addresses of interface %s: %w", iface.Name, err)
+	}
+	var result string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if len(result) == 0 {
+			result = ipNet.IP.String()
+		}
+	}
+	if len(result) == 0 {
+		return "", fmt.Errorf("interface %s has no address", iface.Name)
+	}
+	return result, nil
+}
+
+// listen opens the listener, Unix socket left over from previous run is removed first,
+// then its permissions are set to mode if not 0.
+func listen(network string, address string, mode os.FileMode) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if fInfo, err := os.Stat(address); err == nil && fInfo.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use", address)
+		}
+		if err = os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+	result, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(address, mode); err != nil {
+			result.Close()
+			return nil, fmt.Errorf("error setting unix socket permissions: %w", err)
+		}
+	}
+	return result, nil
+}
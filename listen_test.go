@@ -0,0 +1,90 @@
+package hdproxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		listen      string
+		port        int
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{name: "every interface", listen: "", port: 8080, wantNetwork: "tcp", wantAddress: ":8080"},
+		{name: "ipv4", listen: "127.0.0.1", port: 8080, wantNetwork: "tcp", wantAddress: "127.0.0.1:8080"},
+		{name: "ipv6", listen: "::1", port: 8080, wantNetwork: "tcp", wantAddress: "[::1]:8080"},
+		{name: "ipv6 brackets", listen: "[::1]", port: 0, wantNetwork: "tcp", wantAddress: "[::1]:0"},
+		{name: "host name", listen: "localhost", port: 8080, wantNetwork: "tcp", wantAddress: "localhost:8080"},
+		{name: "unix", listen: "unix:/tmp/hd.sock", port: 8080, wantNetwork: "unix", wantAddress: "/tmp/hd.sock"},
+		{name: "unix without path", listen: "unix:", wantErr: true},
+		{name: "with port", listen: "127.0.0.1:8080", wantErr: true},
+		{name: "unclosed bracket", listen: "[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, address, err := listenAddress(tt.listen, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("listenAddress() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Errorf("listenAddress() got = %v %v, want %v %v", network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestListen_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hd.sock")
+	l, err := listen("unix", path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fInfo, err := os.Stat(path); err != nil || fInfo.Mode().Perm() != 0600 {
+		t.Errorf("socket mode got = %v, %v, want 0600", fInfo, err)
+	}
+	if _, err = listen("unix", path, 0); err == nil {
+		t.Error("listen() on socket in use got no error")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	// stale socket from previous run is replaced
+	l, err = listen("unix", path, 0)
+	if err != nil {
+		t.Fatalf("listen() on stale socket error = %v", err)
+	}
+	l.Close()
+}
+
+func TestListen_AnyPortProxies(t *testing.T) {
+	dir := t.TempDir()
+	proxies := NewProxies()
+	for _, target := range []string{"http://localhost:1", "http://localhost:2"} {
+		p, err := New(WithConfig(ProxyConfig{Target: target, Listen: "127.0.0.1"}), WithLogDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown(context.Background())
+		proxies.Add(p)
+	}
+	list := proxies.List()
+	if len(list) != 2 || list[0].Port() == 0 || list[0].Port() == list[1].Port() {
+		t.Fatalf("port 0 proxies got ports %v", list)
+	}
+	for _, p := range list {
+		if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(p.Port())+".log")); err != nil {
+			t.Errorf("log of port %d: %v", p.Port(), err)
+		}
+	}
+}
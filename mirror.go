@@ -0,0 +1,199 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultMirrorTimeout is used when MirrorConfig.Timeout is not set.
+const defaultMirrorTimeout = 30 * time.Second
+
+type (
+	// MirrorConfig sends a copy of requests to a shadow target, comparing its responses with the primary ones.
+	MirrorConfig struct {
+		// Target is the shadow, mirroring is disabled when empty.
+		Target string
+		// Sample is the fraction of requests mirrored, e.g. 0.1 for 10%, every request when 0.
+		Sample float64
+		// Timeout of the shadow request, default to 30s.
+		Timeout time.Duration
+		// IgnoreHeaders & IgnoreJSON are left out of the diff, see DiffConfig.
+		IgnoreHeaders []string
+		IgnoreJSON    []string
+	}
+
+	// mirror sends requests to the shadow target.
+	mirror struct {
+		targetUrl *url.URL
+		sample    float64
+		client    *http.Client
+		differ    *differ
+	}
+
+	// mirrorCall is a request to the shadow target, done is closed once it's finished.
+	mirrorCall struct {
+		req     *http.Request
+		url     string
+		start   time.Time
+		elapsed time.Duration
+		done    chan struct{}
+		resp    *http.Response
+		body    []byte
+		err     error
+	}
+)
+
+func (c MirrorConfig) enabled() bool {
+	return len(c.Target) > 0
+}
+
+func (c MirrorConfig) validate(errs *ConfigErrors) {
+	if !c.enabled() {
+		return
+	}
+	if _, err := parseTarget(c.Target); err != nil {
+		errs.add("mirror.target", "%v", err)
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		errs.add("mirror.sample", "must be between 0 and 1")
+	}
+	if c.Timeout < 0 {
+		errs.add("mirror.timeout", "must not be negative")
+	}
+	if _, err := newDiffer(DiffConfig{IgnoreHeaders: c.IgnoreHeaders, IgnoreJSON: c.IgnoreJSON}); err != nil {
+		errs.add("mirror.ignorejson", "%v", err)
+	}
+}
+
+// newMirror returns nil when mirroring is disabled.
+func newMirror(config MirrorConfig) (*mirror, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	targetUrl, err := parseTarget(config.Target)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDiffer(DiffConfig{IgnoreHeaders: config.IgnoreHeaders, IgnoreJSON: config.IgnoreJSON})
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultMirrorTimeout
+	}
+	return &mirror{
+		targetUrl: targetUrl,
+		sample:    config.Sample,
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		differ: d,
+	}, nil
+}
+
+// prepare copies req with body for the shadow target if it's sampled, nil is returned otherwise.
+// It must be called before req is rewritten for the primary target, the copy is sent by send.
+func (m *mirror) prepare(req *http.Request, body []byte) *mirrorCall {
+	if m == nil || m.sample > 0 && rand.Float64() >= m.sample {
+		return nil
+	}
+	u := *req.URL
+	u.Scheme = m.targetUrl.Scheme
+	u.Host = m.targetUrl.Host
+	u.Path = m.targetUrl.Path + req.URL.Path
+	u.RawPath = ""
+	call := &mirrorCall{url: u.String(), done: make(chan struct{})}
+	// not bound to the client request, the shadow may well be slower than the primary
+	shadowReq, err := http.NewRequestWithContext(context.Background(), req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		call.err = err
+		return call
+	}
+	shadowReq.Header = req.Header.Clone()
+	shadowReq.Header.Del("Accept-Encoding")
+	shadowReq.ContentLength = int64(len(body))
+	call.req = shadowReq
+	return call
+}
+
+// send sends the copy made by prepare in background, once the primary request is forwarded.
+func (m *mirror) send(call *mirrorCall) {
+	call.start = time.Now()
+	if call.err != nil {
+		close(call.done)
+		return
+	}
+	go func() {
+		defer close(call.done)
+		resp, err := m.client.Do(call.req)
+		if err != nil {
+			call.err = err
+			return
+		}
+		call.body, call.err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		call.resp = resp
+		call.elapsed = time.Since(call.start)
+	}()
+}
+
+// compareMirror compares the shadow response with the primary one in background, once it's done.
+func (p *Proxy) compareMirror(ex *exchange, resp *http.Response, body []byte) {
+	// taken now, resp is no longer ours once ModifyResponse returns
+	redacted, redactedBody := p.redact.Response(resp, body)
+	primary := diffSide{Status: redacted.StatusCode, Header: redacted.Header.Clone(), Body: redactedBody}
+	go p.writeMirrorDiff(ex, resp.Request, &primary, nil)
+}
+
+// mirrorUpstreamError reports the shadow response of a request the primary target failed with err.
+func (p *Proxy) mirrorUpstreamError(ex *exchange, req *http.Request, err error) {
+	go p.writeMirrorDiff(ex, req, nil, err)
+}
+
+// writeMirrorDiff waits for the shadow response, then writes the diff against the primary response,
+// or the primary upstream error when it's nil, to <id>-mirror file & a summary to the access log.
+func (p *Proxy) writeMirrorDiff(ex *exchange, req *http.Request, primary *diffSide, primaryErr error) {
+	call := ex.mirror
+	<-call.done
+	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
+	uri := p.redact.URI(req.RequestURI)
+	if call.err != nil {
+		fmt.Fprintf(p.logWriter, "%s - %s [%s] \"MIRROR %s %s\" error: %v %d\n", req.RemoteAddr, logUser(ex.identity), reqDate, req.Method, uri, call.err, ex.id)
+		return
+	}
+
+	var diffs []string
+	shadow, shadowBody := p.redact.Response(call.resp, call.body)
+	if primary != nil {
+		diffs = p.mirror.differ.Diff(*primary, diffSide{Status: shadow.StatusCode, Header: shadow.Header, Body: shadowBody})
+		fmt.Fprintf(p.logWriter, "%s - %s [%s] \"MIRROR %s %s\" %d %d %d diffs %dms %d\n",
+			req.RemoteAddr, logUser(ex.identity), reqDate, req.Method, uri, primary.Status, call.resp.StatusCode, len(diffs), call.elapsed.Milliseconds(), ex.id)
+	} else {
+		diffs = []string{fmt.Sprintf("upstream error: %v, shadow status %d", primaryErr, call.resp.StatusCode)}
+		fmt.Fprintf(p.logWriter, "%s - %s [%s] \"MIRROR %s %s\" upstream error %d %dms %d\n",
+			req.RemoteAddr, logUser(ex.identity), reqDate, req.Method, uri, call.resp.StatusCode, call.elapsed.Milliseconds(), ex.id)
+	}
+
+	f := p.createDump(ex, "mirror")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s -> %s in %v\n", req.Method, uri, p.redact.URI(call.url), call.elapsed)
+	if len(diffs) == 0 {
+		fmt.Fprintln(f, "same")
+		return
+	}
+	fmt.Fprintln(f, strings.Join(diffs, "\n"))
+}
@@ -0,0 +1,98 @@
+package hdproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is an access log written to by mirror goroutines.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestProxy_Mirror(t *testing.T) {
+	var shadowHits int32
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&shadowHits, 1)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	newProxy := func(config ProxyConfig) (*httptest.Server, *lockedBuffer) {
+		config.Mirror = MirrorConfig{Target: shadow.URL}
+		log := &lockedBuffer{}
+		p, err := New(WithConfig(config), WithLogWriter(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(p), log
+	}
+	waitLog := func(log *lockedBuffer, want string) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !strings.Contains(log.String(), want); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("log got %q, want %q", log.String(), want)
+			}
+		}
+	}
+
+	// no log requests are still compared
+	srv, log := newProxy(ProxyConfig{Target: primary.URL, NoLog: []string{"^/health"}})
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitLog(log, `"MIRROR GET /health" 200 200 1 diffs`)
+
+	// upstream errors get reported too
+	srv, log = newProxy(ProxyConfig{Target: down.URL})
+	defer srv.Close()
+	resp, err = http.Get(srv.URL + "/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitLog(log, `"MIRROR GET /orders" upstream error 200`)
+
+	// requests abandoned at the gate are never mirrored
+	atomic.StoreInt32(&shadowHits, 0)
+	srv, log = newProxy(ProxyConfig{Target: primary.URL, Gate: GateConfig{Enabled: true, Timeout: time.Minute}})
+	defer srv.Close()
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if resp, err = client.Get(srv.URL + "/held"); err == nil {
+		resp.Body.Close()
+		t.Fatal("gated request got answered")
+	}
+	waitLog(log, "not forwarded")
+	time.Sleep(50 * time.Millisecond)
+	if hits := atomic.LoadInt32(&shadowHits); hits != 0 {
+		t.Errorf("abandoned request mirrored %d times", hits)
+	}
+}
@@ -0,0 +1,279 @@
+package hdproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// mockParam matches {name} in mock path pattern.
+var mockParam = regexp.MustCompile(`\{(\w+)\}`)
+
+type (
+	// MockConfig is an endpoint answered by the proxy itself, without contacting the target.
+	MockConfig struct {
+		// Method to match, any method when empty.
+		Method string
+		// Path pattern, {name} matches a path segment available as .Params.name in template,
+		// trailing * matches the rest, e.g. "/users/{id}/orders/*".
+		Path string
+		// Status defaults to 200.
+		Status  int
+		Headers map[string]string
+		// Body inline, or read from BodyFile.
+		Body     string
+		BodyFile string
+		// Template renders the body & header values as text/template, with .Method, .Path,
+		// .Params, .Query & .Header of the request, e.g. {{.Params.id}} or {{.Query.Get "q"}}.
+		Template bool
+	}
+
+	// mock is a compiled MockConfig.
+	mock struct {
+		method  string
+		path    *regexp.Regexp
+		status  int
+		headers map[string]string
+		body    []byte
+		// templates of headers & body, only when MockConfig.Template is set
+		headerTmpls map[string]*template.Template
+		tmpl        *template.Template
+	}
+
+	// mockData is what mock templates can refer to.
+	mockData struct {
+		Method string
+		Path   string
+		Params map[string]string
+		Query  url.Values
+		Header http.Header
+	}
+)
+
+func compileMocks(configs []MockConfig) ([]*mock, ConfigErrors) {
+	var errs ConfigErrors
+	result := make([]*mock, 0, len(configs))
+	for i, config := range configs {
+		m, err := compileMock(config)
+		if err != nil {
+			errs.add("mocks."+strconv.Itoa(i), "%v", err)
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, errs
+}
+
+func compileMock(config MockConfig) (*mock, error) {
+	if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", config.Path)
+	}
+	if config.Status == 0 {
+		config.Status = http.StatusOK
+	}
+	if config.Status < 100 || config.Status > 999 {
+		return nil, fmt.Errorf("invalid status %d", config.Status)
+	}
+	result := &mock{
+		method:  strings.ToUpper(strings.TrimSpace(config.Method)),
+		path:    compileMockPath(config.Path),
+		status:  config.Status,
+		headers: config.Headers,
+		body:    []byte(config.Body),
+	}
+	if len(config.BodyFile) > 0 {
+		if len(config.Body) > 0 {
+			return nil, fmt.Errorf("either body or bodyfile, not both")
+		}
+		body, err := os.ReadFile(config.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.body = body
+		if contentType := mime.TypeByExtension(filepath.Ext(config.BodyFile)); len(contentType) > 0 && !hasHeader(config.Headers, "Content-Type") {
+			result.headers = map[string]string{"Content-Type": contentType}
+			for name, value := range config.Headers {
+				result.headers[name] = value
+			}
+		}
+	}
+	if !config.Template {
+		return result, nil
+	}
+	result.headerTmpls = make(map[string]*template.Template, len(config.Headers))
+	for name, value := range config.Headers {
+		tmpl, err := parseMockTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		result.headerTmpls[name] = tmpl
+	}
+	tmpl, err := parseMockTemplate(string(result.body))
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	result.tmpl = tmpl
+	return result, nil
+}
+
+// compileMockPath turns path pattern into regex, everything but {name} & trailing * is literal.
+func compileMockPath(pattern string) *regexp.Regexp {
+	wildcard := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+	var sb strings.Builder
+	sb.WriteString("^")
+	last := 0
+	for _, loc := range mockParam.FindAllStringSubmatchIndex(pattern, -1) {
+		sb.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		sb.WriteString("(?P<" + pattern[loc[2]:loc[3]] + ">[^/]+)")
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(pattern[last:]))
+	if wildcard {
+		sb.WriteString(".*")
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// hasHeader reports whether headers has name, case insensitive as config keys may be lowercased.
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMockTemplate(s string) (*template.Template, error) {
+	return template.New("mock").Option("missingkey=zero").Parse(s)
+}
+
+// match returns the path params if r matches the mock, nil otherwise.
+func (m *mock) match(r *http.Request) map[string]string {
+	if len(m.method) > 0 && m.method != r.Method {
+		return nil
+	}
+	matches := m.path.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		return nil
+	}
+	params := make(map[string]string)
+	for i, name := range m.path.SubexpNames() {
+		if len(name) > 0 {
+			params[name] = matches[i]
+		}
+	}
+	return params
+}
+
+// findMock returns the first mock matching r along with its path params.
+func (p *Proxy) findMock(r *http.Request) (*mock, map[string]string) {
+	for _, m := range p.mocks {
+		if params := m.match(r); params != nil {
+			return m, params
+		}
+	}
+	return nil, nil
+}
+
+// response builds the mock response to req, as if it came from upstream.
+func (m *mock) response(req *http.Request, params map[string]string) (*http.Response, []byte, error) {
+	data := mockData{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Params: params,
+		Query:  req.URL.Query(),
+		Header: req.Header,
+	}
+	header := make(http.Header)
+	for name, value := range m.headers {
+		header.Set(name, value)
+	}
+	for name, tmpl := range m.headerTmpls {
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		header.Set(name, value.String())
+	}
+	body := m.body
+	if m.tmpl != nil {
+		var buf bytes.Buffer
+		if err := m.tmpl.Execute(&buf, data); err != nil {
+			return nil, nil, fmt.Errorf("body: %w", err)
+		}
+		body = buf.Bytes()
+	}
+	if len(header.Get("Content-Type")) == 0 && len(body) > 0 {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", m.status, http.StatusText(m.status)),
+		StatusCode:    m.status,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	return resp, body, nil
+}
+
+// serveMock answers r with mock m, logged & dumped like proxied traffic.
+func (p *Proxy) serveMock(w http.ResponseWriter, r *http.Request, ex *exchange, m *mock, params map[string]string) {
+	body, err := readBody(&r.Body)
+	if err != nil {
+		http.Error(w, "error reading request", bodyErrorStatus(err))
+		return
+	}
+	ex.reqBody = body
+	// dumps show the proxy itself as the upstream
+	req := r.Clone(r.Context())
+	req.URL.Scheme = "http"
+	if r.TLS != nil {
+		req.URL.Scheme = "https"
+	}
+	req.URL.Host = r.Host
+	if !ex.noLog {
+		reqDump, err := p.dumpRequest(r, body)
+		if err != nil {
+			fmt.Fprintln(p.logWriter, "error dumping req", p.redact.URI(r.RequestURI), err)
+		} else {
+			p.writeReqDump(ex, req, reqDump)
+		}
+	}
+	if !p.hold(r, ex) {
+		return
+	}
+
+	resp, respBody, err := m.response(req, params)
+	if err != nil {
+		fmt.Fprintln(p.logWriter, "mock error", p.redact.String(r.URL.Path), err)
+		http.Error(w, "mock error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ex.noLog {
+		p.logResponse(ex, resp, respBody)
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write(respBody)
+	}
+}
@@ -0,0 +1,71 @@
+package hdproxy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMock_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MockConfig
+		method string
+		target string
+		want   map[string]string
+	}{
+		{name: "exact", config: MockConfig{Path: "/health"}, method: "GET", target: "/health", want: map[string]string{}},
+		{name: "no match", config: MockConfig{Path: "/health"}, method: "GET", target: "/health/x", want: nil},
+		{name: "params", config: MockConfig{Path: "/users/{id}/orders/{order}"}, method: "GET", target: "/users/7/orders/9?x=1",
+			want: map[string]string{"id": "7", "order": "9"}},
+		{name: "param is one segment", config: MockConfig{Path: "/users/{id}"}, method: "GET", target: "/users/7/orders", want: nil},
+		{name: "wildcard", config: MockConfig{Path: "/static/*"}, method: "GET", target: "/static/a/b.js", want: map[string]string{}},
+		{name: "literal regex chars", config: MockConfig{Path: "/a.b"}, method: "GET", target: "/axb", want: nil},
+		{name: "method", config: MockConfig{Method: "post", Path: "/users"}, method: "POST", target: "/users", want: map[string]string{}},
+		{name: "other method", config: MockConfig{Method: "POST", Path: "/users"}, method: "GET", target: "/users", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := compileMock(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := m.match(httptest.NewRequest(tt.method, tt.target, nil))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMock_Response(t *testing.T) {
+	m, err := compileMock(MockConfig{
+		Path:     "/users/{id}",
+		Status:   201,
+		Headers:  map[string]string{"content-type": "application/json", "X-Id": "{{.Params.id}}"},
+		Body:     `{"id":{{.Params.id}},"q":"{{.Query.Get "q"}}","agent":"{{.Header.Get "User-Agent"}}"}`,
+		Template: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/users/7?q=x", nil)
+	req.Header.Set("User-Agent", "test")
+	resp, body, err := m.response(req, m.match(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 || resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("X-Id") != "7" {
+		t.Errorf("response() got = %v %v", resp.StatusCode, resp.Header)
+	}
+	if want := `{"id":7,"q":"x","agent":"test"}`; string(body) != want {
+		t.Errorf("response() body got = %s, want %s", body, want)
+	}
+
+	if _, err = compileMock(MockConfig{Path: "/a", Body: "{{.Params.id", Template: true}); err == nil {
+		t.Error("compileMock() invalid template got no error")
+	}
+	if _, err = compileMock(MockConfig{Path: "a"}); err == nil {
+		t.Error("compileMock() relative path got no error")
+	}
+}
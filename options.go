@@ -0,0 +1,98 @@
+package hdproxy
+
+import (
+	"io"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+type (
+	// Option configures a proxy created by New.
+	Option func(*options)
+
+	options struct {
+		config    ProxyConfig
+		logWriter io.Writer
+		logDir    string
+		logStdout bool
+		sinks     []Sink
+	}
+
+	// Sink gets every exchange the proxy captures, as the HAR entry also kept for the admin API & HAR file.
+	// Capture is called on the response path of each request, concurrently, so it should be quick.
+	// e must not be modified.
+	Sink interface {
+		Capture(e *harlog.Entry)
+	}
+
+	// SinkFunc adapts a function to Sink.
+	SinkFunc func(e *harlog.Entry)
+)
+
+func (f SinkFunc) Capture(e *harlog.Entry) {
+	f(e)
+}
+
+// Capture adds e, so a HarCapture can be a Sink too.
+func (h *HarCapture) Capture(e *harlog.Entry) {
+	h.Add(e)
+}
+
+// WithConfig sets the whole config of the proxy, later options override parts of it.
+func WithConfig(config ProxyConfig) Option {
+	return func(o *options) {
+		o.config = config
+	}
+}
+
+// WithTarget sets the upstream the proxy forwards to, e.g. the URL of an httptest.Server.
+func WithTarget(target string) Option {
+	return func(o *options) {
+		o.config.Target = target
+	}
+}
+
+// WithHold delays every request by hold before forwarding it.
+func WithHold(hold time.Duration) Option {
+	return func(o *options) {
+		o.config.Hold = hold
+	}
+}
+
+// WithMocks adds endpoints answered by the proxy itself.
+func WithMocks(mocks ...MockConfig) Option {
+	return func(o *options) {
+		o.config.Mocks = append(o.config.Mocks, mocks...)
+	}
+}
+
+// WithLogWriter sends the access log to w, it's discarded otherwise.
+func WithLogWriter(w io.Writer) Option {
+	return func(o *options) {
+		o.logWriter = w
+	}
+}
+
+// WithLogDir writes the access log to <dir>/<port>.log, dump files to <dir>/<port>/
+// and HAR file <dir>/<port>.har on shutdown, with port 0 they're named after the port picked by Listen.
+// Without it no file is written, exchanges can't be replayed and admin API has no snippets then.
+func WithLogDir(dir string) Option {
+	return func(o *options) {
+		o.logDir = dir
+	}
+}
+
+// withLogStdout adds stdout to the access log, prefixed with the port like the hdproxy command does.
+func withLogStdout() Option {
+	return func(o *options) {
+		o.logStdout = true
+	}
+}
+
+// WithSink adds s to get every captured exchange.
+func WithSink(s Sink) Option {
+	return func(o *options) {
+		o.sinks = append(o.sinks, s)
+	}
+}
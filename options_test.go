@@ -0,0 +1,137 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+func TestNew_Sink(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer upstream.Close()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var (
+		mutex   sync.Mutex
+		entries []*harlog.Entry
+		log     bytes.Buffer
+	)
+	p, err := New(WithTarget(upstream.URL), WithLogWriter(&log), WithSink(SinkFunc(func(e *harlog.Entry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		entries = append(entries, e)
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(entries) != 1 || entries[0].Request.URL != upstream.URL+"/ping" || entries[0].Response.Content.Text != "pong" {
+		t.Errorf("sink got %+v", entries)
+	}
+	if !strings.Contains(log.String(), "GET /ping") {
+		t.Errorf("log got %q", log.String())
+	}
+	if files, _ := os.ReadDir(dir); len(files) > 0 {
+		t.Errorf("files written without log dir: %v", files)
+	}
+	if _, err = p.Replay(context.Background(), 1, ReplayEdits{}); err == nil {
+		t.Error("replay without dump files got no error")
+	}
+}
+
+func TestNewProxy_LogDir(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := New(WithTarget("http://localhost:1"), WithConfig(ProxyConfig{Port: 8080})); err == nil {
+		t.Error("WithConfig after WithTarget kept the target")
+	}
+	if _, err := NewProxy(ProxyConfig{Port: 8080, Target: "http://localhost:1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{"log/8080", "log/8080.log"} {
+		if _, err := os.Stat(fname); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestNewProxy_AnyPort(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	var ports []int
+	for i := 0; i < 2; i++ {
+		p, err := NewProxy(ProxyConfig{Target: "http://localhost:1", Listen: "127.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		defer p.Shutdown(context.Background())
+		ports = append(ports, p.Port())
+	}
+	if ports[0] == 0 || ports[0] == ports[1] {
+		t.Fatalf("ports got %v", ports)
+	}
+	for _, port := range ports {
+		if _, err := os.Stat(fmt.Sprintf("log/%d.log", port)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat("log/0.log"); err == nil {
+		t.Error("log/0.log created")
+	}
+}
+
+func TestProxy_ShutdownRotatesHAR(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	p, err := New(WithConfig(ProxyConfig{Port: 8080}), WithTarget(upstream.URL), WithLogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+		p.Shutdown(context.Background())
+	}
+	hars, _ := filepath.Glob(filepath.Join(dir, "8080*.har"))
+	if len(hars) != 2 {
+		t.Errorf("HAR files got %v, want 8080.har & a rotated one", hars)
+	}
+}
@@ -0,0 +1,136 @@
+package hdproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Upstream protocols of ProxyConfig.UpstreamProtocol.
+const (
+	upstreamAuto  = ""      // HTTP/2 if upstream offers it over TLS, HTTP/1.1 otherwise
+	upstreamHTTP1 = "http1" // always HTTP/1.1
+	upstreamHTTP2 = "http2" // always HTTP/2, h2c prior knowledge for http:// target
+)
+
+type (
+	TLSConfig struct {
+		// CertFile & KeyFile in PEM format, the listener serves HTTPS when set.
+		CertFile string
+		KeyFile  string
+	}
+
+	// h2Transport sends HTTP/2 to upstream, over TLS for https, prior knowledge cleartext (h2c) for http.
+	h2Transport struct {
+		tls       *http2.Transport
+		cleartext *http2.Transport
+	}
+)
+
+func (c TLSConfig) enabled() bool {
+	return len(c.CertFile) > 0 || len(c.KeyFile) > 0
+}
+
+func validateProtocols(c ProxyConfig, errs *ConfigErrors) {
+	if c.TLS.enabled() {
+		if len(c.TLS.CertFile) == 0 || len(c.TLS.KeyFile) == 0 {
+			errs.add("tls", "both CertFile and KeyFile are required")
+		} else if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			errs.add("tls", "%v", err)
+		}
+		if c.H2C {
+			errs.add("h2c", "h2c is for cleartext listener, use H2 with TLS")
+		}
+	} else if c.H2 {
+		errs.add("h2", "h2 requires TLS, use H2C for cleartext listener")
+	}
+	switch strings.ToLower(c.UpstreamProtocol) {
+	case upstreamAuto, upstreamHTTP1, upstreamHTTP2:
+	default:
+		errs.add("upstreamprotocol", "invalid upstream protocol %q, expecting http1 or http2", c.UpstreamProtocol)
+	}
+}
+
+// configureServer sets up srv according to the listener protocols of config, handler is wrapped for h2c.
+func configureServer(srv *http.Server, config ProxyConfig) error {
+	if config.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+	if !config.TLS.enabled() {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err = config.Auth.configureClientAuth(srv.TLSConfig); err != nil {
+		return err
+	}
+	if config.H2 {
+		return http2.ConfigureServer(srv, &http2.Server{})
+	}
+	// non-nil empty map disables HTTP/2
+	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	return nil
+}
+
+// upstreamTransport returns the transport to upstream for protocol, gRPC calls always go over HTTP/2.
+func upstreamTransport(protocol string, timeouts TimeoutsConfig) http.RoundTripper {
+	h2 := &h2Transport{tls: newHTTP2Transport(timeouts), cleartext: newHTTP2Transport(timeouts)}
+	h2.cleartext.AllowHTTP = true
+	h2.cleartext.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return timeouts.dial(ctx, network, addr)
+	}
+	if timeouts.Dial > 0 || timeouts.TLSHandshake > 0 {
+		h2.tls.DialTLSContext = timeouts.dialTLS
+	}
+	switch strings.ToLower(protocol) {
+	case upstreamHTTP1:
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		t.TLSClientConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+		timeouts.configureTransport(t)
+		return grpcTransport{RoundTripper: t, h2: h2}
+	case upstreamHTTP2:
+		return h2
+	default:
+		if !timeouts.upstream() {
+			return grpcTransport{RoundTripper: http.DefaultTransport, h2: h2}
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		timeouts.configureTransport(t)
+		return grpcTransport{RoundTripper: t, h2: h2}
+	}
+}
+
+// newHTTP2Transport returns an HTTP/2 transport with the ResponseHeader & UpstreamIdle timeouts.
+// http2.Transport only takes them from the http.Transport it's configured for, so it gets one
+// holding them, yet keeps dialing on its own rather than through it.
+func newHTTP2Transport(timeouts TimeoutsConfig) *http2.Transport {
+	t1 := &http.Transport{ResponseHeaderTimeout: timeouts.ResponseHeader, IdleConnTimeout: timeouts.UpstreamIdle}
+	t, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		// only when t1 has HTTP/2 configured already
+		return &http2.Transport{}
+	}
+	t.ConnPool = nil
+	return t
+}
+
+func (t *h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case "https":
+		return t.tls.RoundTrip(req)
+	case "http":
+		return t.cleartext.RoundTrip(req)
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+}
@@ -0,0 +1,59 @@
+package hdproxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+type (
+	// Proxies keeps every proxy by port, so they can be looked up & managed at runtime.
+	Proxies struct {
+		mutex   sync.RWMutex
+		proxies map[int]*Proxy
+	}
+)
+
+func NewProxies() *Proxies {
+	return &Proxies{proxies: make(map[int]*Proxy)}
+}
+
+func (ps *Proxies) Add(p *Proxy) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.proxies[p.Port()] = p
+}
+
+// Get returns the proxy listening on port, or nil.
+func (ps *Proxies) Get(port int) *Proxy {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return ps.proxies[port]
+}
+
+// List returns all proxies sorted by port.
+func (ps *Proxies) List() []*Proxy {
+	ps.mutex.RLock()
+	result := make([]*Proxy, 0, len(ps.proxies))
+	for _, p := range ps.proxies {
+		result = append(result, p)
+	}
+	ps.mutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Port() < result[j].Port()
+	})
+	return result
+}
+
+// Shutdown drains every proxy at once, so they share the time ctx allows.
+func (ps *Proxies) Shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range ps.List() {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.Shutdown(ctx)
+		}(p)
+	}
+	wg.Wait()
+}
@@ -1,15 +1,18 @@
-package main
+package hdproxy
 
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,80 +20,420 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/siroj100/hdproxy/harlog"
 )
 
 type (
+	// exchange follows a single request through the reverse proxy via its context.
+	exchange struct {
+		id      int64 // also the dump file name
+		start   time.Time
+		sent    time.Time
+		noLog   bool
+		reqBody []byte
+		// identity authenticated by the auth gate, if any
+		identity string
+		// replayOf is the id of the exchange this one replays, 0 for live traffic
+		replayOf int64
+		// reqDump & grpcReq are kept until gRPC streams end, see finishGRPC
+		reqDump []byte
+		grpcReq *captureBody
+		// mirror is the copy sent to the shadow target, if any
+		mirror *mirrorCall
+		// cache is what the response cache did, nil when not involved
+		cache *cacheResult
+		// abandoned is set when the client went away while the request was held, it's not forwarded then
+		abandoned bool
+		// bodyErr is set when the request body couldn't be read, it's not forwarded then
+		bodyErr error
+		// settings at the time request came in, so it's not affected by changes from admin API midway
+		settings *proxySettings
+	}
+
+	// proxySettings are the parts of a Proxy that can be changed at runtime, never modified once in use.
+	proxySettings struct {
+		target        string
+		targetUrl     *url.URL
+		hold          time.Duration
+		noLog         []*regexp.Regexp
+		noLogPatterns []string
+		// breakpoints pause matching exchanges, see Proxy.pause
+		breakpoints       []*breakpoint
+		breakpointConfigs []BreakpointConfig
+		// gate holds matching requests until released, nil when disabled
+		gate       *regexp.Regexp
+		gateConfig GateConfig
+	}
+
+	exchangeKey struct{}
+
+	// Proxy is a logging reverse proxy. It's an http.Handler too, so it can be served without Listen,
+	// e.g. by httptest.NewServer.
 	Proxy struct {
-		port       int
-		target     string
-		hold       time.Duration
-		targetUrl  *url.URL
-		reqTimeMap sync.Map
+		// config the proxy is created with, runtime settings are in current instead
+		config ProxyConfig
+		// logDir holds <port>.log & <port>.har, logDirName the dump files, both empty when nothing is written
+		logDir     string
 		logDirName string
 		logWriter  io.Writer
-		noLog      []*regexp.Regexp
-
-		srv          http.Server
+		// logStdout adds stdout to the access log, prefixed with the port
+		logStdout bool
+		// logsOpen is set once the port is known & the log files are created, on first Listen for port 0
+		logsOpen bool
+		// sinks get every HAR entry captured
+		sinks  []Sink
+		redact *Redactor
+		grpc   *GRPCDecoder
+		mocks  []*mock
+		mirror *mirror
+		cache  *responseCache
+		access *accessList
+		auth   *authGate
+		// rateLimits & concurrency throttle clients before anything else
+		rateLimits  []*rateLimit
+		concurrency *concurrencyLimit
+		har         *HarCapture
+		paused      pausedExchanges
+		gate        requestGate
+		flights     inFlight
+
+		mutex        sync.RWMutex
+		current      *proxySettings
+		srv          *http.Server
+		listener     net.Listener
 		reverseProxy *httputil.ReverseProxy
 	}
 )
 
-func NewProxy(config ProxyConfig) *Proxy {
-	targetUrl, err := url.Parse(config.Target)
+// NewProxy creates the proxy the way the hdproxy command does: access log to stdout & log/<port>.log,
+// dump files in log/<port>/ and HAR file log/<port>.har on shutdown.
+func NewProxy(config ProxyConfig) (*Proxy, error) {
+	return New(WithConfig(config), WithLogDir("log"), withLogStdout())
+}
+
+// New creates a proxy from opts. Unless told otherwise with WithLogWriter & WithLogDir,
+// it logs nothing & writes no files.
+func New(opts ...Option) (*Proxy, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	config := o.config
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	targetUrl, _ := parseTarget(config.Target)
+	noLog, _ := compileNoLog(config.NoLog)
+	redact, _ := NewRedactor(config.Redact)
+	mocks, _ := compileMocks(config.Mocks)
+	mirror, _ := newMirror(config.Mirror)
+	rateLimits, _ := newRateLimits(config.RateLimits)
+	access, _ := newAccessList(config.Access)
+	breakpoints, _ := compileBreakpoints(config.Breakpoints)
+	gate, _ := compileGate(config.Gate)
+	transport := upstreamTransport(config.UpstreamProtocol, config.Timeouts)
+	cache, _ := newResponseCache(config.Cache, transport)
+	if cache != nil {
+		transport = cache
+	}
+	grpc, err := NewGRPCDecoder(config.GRPC)
 	if err != nil {
-		log.Fatalln("invalid target url")
+		return nil, fmt.Errorf("error loading grpc descriptors: %w", err)
+	}
+	logWriter := o.logWriter
+	if logWriter == nil {
+		logWriter = io.Discard
+	}
+	harSize := config.HarSize
+	if harSize == 0 {
+		harSize = defaultHarSize
+	}
+	result := &Proxy{
+		config:      config,
+		logDir:      o.logDir,
+		logWriter:   logWriter,
+		logStdout:   o.logStdout,
+		sinks:       o.sinks,
+		redact:      redact,
+		grpc:        grpc,
+		mocks:       mocks,
+		mirror:      mirror,
+		cache:       cache,
+		access:      access,
+		auth:        newAuthGate(config.Auth),
+		rateLimits:  rateLimits,
+		concurrency: newConcurrencyLimit(config.Concurrency),
+		har:         NewHarCapture(harSize),
+		paused:      pausedExchanges{byID: make(map[int64]*pausedExchange)},
+		current: &proxySettings{
+			target:            config.Target,
+			targetUrl:         targetUrl,
+			hold:              config.Hold,
+			noLog:             noLog,
+			noLogPatterns:     append([]string{}, config.NoLog...),
+			breakpoints:       breakpoints,
+			breakpointConfigs: append([]BreakpointConfig{}, config.Breakpoints...),
+			gate:              gate,
+			gateConfig:        config.Gate,
+		},
+	}
+	rp := &httputil.ReverseProxy{
+		Director:       result.proxyDirector,
+		ModifyResponse: result.proxyModifyResponse,
+		ErrorHandler:   result.proxyErrorHandler,
+		Transport:      transport,
+	}
+	result.reverseProxy = rp
+	// port 0 is known once listening, so are its log files
+	if config.Port != 0 {
+		if err = result.openLogs(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// openLogs adds stdout & <logDir>/<port>.log to the access log and creates the dump folder, as set by the options.
+func (p *Proxy) openLogs() error {
+	p.logsOpen = true
+	port := strconv.Itoa(p.config.Port)
+	writers := []io.Writer{p.logWriter}
+	if p.logStdout {
+		writers = append(writers, NewPrefixedWriter(os.Stdout, port))
+	}
+	if len(p.logDir) > 0 {
+		logDirName := filepath.Join(p.logDir, port)
+		if err := os.MkdirAll(logDirName, 0700); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error create log folder: %w", err)
+		}
+		logFn := filepath.Join(p.logDir, port+".log")
+		for _, ext := range []string{"log", "har"} {
+			if err := rotateLogFile(p.logDir, p.config.Port, ext); err != nil {
+				fmt.Fprintln(p.logWriter, err)
+			}
+		}
+		logFile, err := os.Create(logFn)
+		if err != nil {
+			return fmt.Errorf("error creating log file: %w", err)
+		}
+		writers = append(writers, logFile)
+		p.logDirName = logDirName
 	}
-	logDirName := fmt.Sprintf("log/%d", config.Port)
-	if err = os.MkdirAll(logDirName, 0700); err != nil && !os.IsExist(err) {
-		log.Fatalln("error create log folder", err)
+	if len(writers) > 1 {
+		p.logWriter = io.MultiWriter(writers...)
 	}
-	logFn := fmt.Sprintf("log/%d.log", config.Port)
+	return nil
+}
+
+// rotateLogFile renames <dir>/<port>.<ext> from previous run, if any, so we start with fresh one.
+func rotateLogFile(dir string, port int, ext string) error {
+	logFn := filepath.Join(dir, fmt.Sprintf("%d.%s", port, ext))
 	fInfo, err := os.Stat(logFn)
 	if err == nil && fInfo.Size() > 0 {
-		logFnRename := fmt.Sprintf("log/%d-%s.log", config.Port, fInfo.ModTime().Format("20060102150405"))
+		logFnRename := filepath.Join(dir, fmt.Sprintf("%d-%s.%s", port, fInfo.ModTime().Format("20060102150405"), ext))
 		if err = os.Rename(logFn, logFnRename); err != nil {
-			log.Println("Error renaming ", logFn, "to", logFnRename)
+			return fmt.Errorf("error renaming %s to %s: %w", logFn, logFnRename, err)
 		}
 	}
-	logFile, err := os.Create(logFn)
+	return nil
+}
+
+// Port returns the port of the proxy, for port 0 the one picked on first Listen.
+func (p *Proxy) Port() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.config.Port
+}
+
+// Config returns the current runtime settings of the proxy.
+func (p *Proxy) Config() ProxyConfig {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	result := p.config
+	result.Target = p.current.target
+	result.Hold = p.current.hold
+	result.NoLog = p.current.noLogPatterns
+	result.Breakpoints = p.current.breakpointConfigs
+	result.Gate = p.current.gateConfig
+	return result
+}
+
+func (p *Proxy) settings() *proxySettings {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.current
+}
+
+// updateSettings applies fn on a copy of current settings, requests already in flight keep using the old one.
+func (p *Proxy) updateSettings(fn func(s *proxySettings)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	settings := *p.current
+	fn(&settings)
+	p.current = &settings
+}
+
+// parseTarget parses & checks target is an absolute http(s) URL.
+func parseTarget(target string) (*url.URL, error) {
+	targetUrl, err := url.Parse(target)
 	if err != nil {
-		log.Fatalln("Error creating log file", logFn)
+		return nil, fmt.Errorf("invalid target url: %w", err)
+	}
+	if targetUrl.Scheme != "http" && targetUrl.Scheme != "https" || len(targetUrl.Host) == 0 {
+		return nil, fmt.Errorf("invalid target url %q, must be http(s)://host[:port][/path]", target)
 	}
-	logWriter := io.MultiWriter(NewPrefixedWriter(os.Stdout, strconv.Itoa(config.Port)), logFile)
-	noLog := make([]*regexp.Regexp, 0)
-	for _, pattern := range config.NoLog {
+	return targetUrl, nil
+}
+
+func compileNoLog(patterns []string) ([]*regexp.Regexp, error) {
+	noLog := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
 		rx, err := regexp.Compile(pattern)
 		if err != nil {
-			log.Println(config.Port, ": Ignoring invalid noLog pattern", pattern, ", error:", err)
-		} else {
-			noLog = append(noLog, rx)
+			return nil, fmt.Errorf("invalid noLog pattern %q: %w", pattern, err)
 		}
+		noLog = append(noLog, rx)
 	}
-	result := &Proxy{
-		port:       config.Port,
-		target:     config.Target,
-		hold:       config.Hold,
-		reqTimeMap: sync.Map{},
-		logDirName: logDirName,
-		logWriter:  logWriter,
-		targetUrl:  targetUrl,
-		noLog:      noLog,
+	return noLog, nil
+}
+
+func (p *Proxy) SetTarget(target string) error {
+	targetUrl, err := parseTarget(target)
+	if err != nil {
+		return err
 	}
-	rp := &httputil.ReverseProxy{
-		Director:       result.proxyDirector,
-		ModifyResponse: result.proxyModifyResponse,
-		ErrorHandler:   result.proxyErrorHandler,
+	p.updateSettings(func(s *proxySettings) {
+		s.target = target
+		s.targetUrl = targetUrl
+	})
+	return nil
+}
+
+// withTarget returns a copy of s sending to target instead, s itself when target is empty.
+func (s *proxySettings) withTarget(target string) (*proxySettings, error) {
+	if len(target) == 0 {
+		return s, nil
 	}
-	result.reverseProxy = rp
-	return result
+	targetUrl, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	result := *s
+	result.target = target
+	result.targetUrl = targetUrl
+	return &result, nil
+}
+
+func (p *Proxy) SetHold(hold time.Duration) {
+	p.updateSettings(func(s *proxySettings) {
+		s.hold = hold
+	})
+}
+
+func (p *Proxy) SetNoLog(patterns []string) error {
+	noLog, err := compileNoLog(patterns)
+	if err != nil {
+		return err
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.noLog = noLog
+		s.noLogPatterns = append([]string{}, patterns...)
+	})
+	return nil
+}
+
+// Update applies the runtime parts of config at once: target, hold, noLog, breakpoints & listen address,
+// the latter taking effect on next start. Nothing is changed when any of them is invalid.
+func (p *Proxy) Update(config ProxyConfig) error {
+	targetUrl, err := parseTarget(config.Target)
+	if err != nil {
+		return err
+	}
+	noLog, err := compileNoLog(config.NoLog)
+	if err != nil {
+		return err
+	}
+	breakpoints, errs := compileBreakpoints(config.Breakpoints)
+	if len(errs) > 0 {
+		return errs
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.target = config.Target
+		s.targetUrl = targetUrl
+		s.hold = config.Hold
+		s.noLog = noLog
+		s.noLogPatterns = append([]string{}, config.NoLog...)
+		s.breakpoints = breakpoints
+		s.breakpointConfigs = append([]BreakpointConfig{}, config.Breakpoints...)
+		// under the same lock as the settings
+		p.config.Listen = config.Listen
+		p.config.SocketMode = config.SocketMode
+	})
+	return nil
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ok := p.checkAccess(w, r)
+	if !ok {
+		return
+	}
+	if !p.limit(w, r, client) {
+		return
+	}
+	defer p.concurrency.release()
+	identity, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	ex := p.newExchange(r, identity, p.settings())
 	if p.isWebSocketRequest(r) {
-		p.handleWebSocket(w, r)
+		p.handleWebSocket(w, r, ex)
 		return
 	}
-	p.reverseProxy.ServeHTTP(w, r)
+	p.serveExchange(w, r, ex)
+}
+
+func (p *Proxy) newExchange(r *http.Request, identity string, settings *proxySettings) *exchange {
+	now := time.Now()
+	return &exchange{
+		id:       now.UnixNano(),
+		start:    now,
+		noLog:    settings.isNoLog(r.RequestURI),
+		identity: identity,
+		settings: settings,
+	}
+}
+
+// serveExchange answers r from a mock or the target, once it's past access checks.
+func (p *Proxy) serveExchange(w http.ResponseWriter, r *http.Request, ex *exchange) {
+	p.flights.add(ex, r.Method, p.redact.URI(r.RequestURI))
+	defer p.flights.remove(ex)
+	if ex.settings.breaks(r, breakRequest) && !p.breakRequest(w, r, ex) {
+		return
+	}
+	if m, params := p.findMock(r); m != nil {
+		p.serveMock(w, r, ex, m, params)
+		return
+	}
+	p.reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)))
+}
+
+func exchangeFrom(ctx context.Context) *exchange {
+	if ex, ok := ctx.Value(exchangeKey{}).(*exchange); ok {
+		return ex
+	}
+	// shouldn't happen, but better than nil pointer
+	now := time.Now()
+	return &exchange{id: now.UnixNano(), start: now, settings: &proxySettings{targetUrl: &url.URL{}}}
+}
+
+func (s *proxySettings) isNoLog(requestURI string) bool {
+	for _, rx := range s.noLog {
+		if rx.MatchString(requestURI) {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *Proxy) isWebSocketRequest(r *http.Request) bool {
@@ -98,29 +441,29 @@ func (p *Proxy) isWebSocketRequest(r *http.Request) bool {
 		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
 }
 
-func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request, ex *exchange) {
 	// Build upstream URL (ws:// or wss://)
-	targetURL := *p.targetUrl
+	settings := ex.settings
+	targetURL := *settings.targetUrl
 	if targetURL.Scheme == "http" {
 		targetURL.Scheme = "ws"
 	} else if targetURL.Scheme == "https" {
 		targetURL.Scheme = "wss"
 	}
-	targetURL.Path = p.targetUrl.Path + r.URL.Path
+	targetURL.Path = settings.targetUrl.Path + r.URL.Path
 	targetURL.RawQuery = r.URL.RawQuery
 
 	// Log the WebSocket connection attempt
-	timestamp := time.Now().UnixNano()
-	key := r.RemoteAddr + " " + r.Method + " " + r.RequestURI
-	p.reqTimeMap.Store(key, timestamp)
-
 	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
-	fmt.Fprintf(p.logWriter, "%s - - [%s] \"WS %s %s\" -> %s\n",
-		r.RemoteAddr, reqDate, r.URL.Path, r.Proto, targetURL.String())
+	logPath := p.redact.String(r.URL.Path)
+	fmt.Fprintf(p.logWriter, "%s - %s [%s] \"WS %s %s\" -> %s\n",
+		r.RemoteAddr, logUser(ex.identity), reqDate, logPath, r.Proto, p.redact.URI(targetURL.String()))
 
 	// Prepare dialer for upstream connection
+	timeouts := p.config.Timeouts
 	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+		NetDialContext:   timeouts.dial,
+		HandshakeTimeout: timeouts.webSocketHandshake(),
 	}
 
 	// Copy relevant headers (skip WebSocket-specific hop-by-hop headers)
@@ -139,9 +482,14 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Connect to upstream WebSocket server
 	upstreamConn, resp, err := dialer.Dial(targetURL.String(), requestHeader)
 	if err != nil {
-		errMsg := fmt.Sprintf("WebSocket dial error to %s: %v", targetURL.String(), err)
-		log.Println(errMsg)
-		if resp != nil {
+		fmt.Fprintf(p.logWriter, "WebSocket dial error to %s: %v\n", p.redact.URI(targetURL.String()), err)
+		if phase := timeoutPhase(err); len(phase) > 0 {
+			if phase == phaseUpstream {
+				phase = "websocket handshake"
+			}
+			p.logRejected(r, http.StatusGatewayTimeout, "timeout "+phase)
+			http.Error(w, "WebSocket upstream timeout", http.StatusGatewayTimeout)
+		} else if resp != nil {
 			http.Error(w, fmt.Sprintf("WebSocket upstream error: %d", resp.StatusCode), resp.StatusCode)
 		} else {
 			http.Error(w, "WebSocket upstream connection failed", http.StatusBadGateway)
@@ -159,13 +507,16 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	clientConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket client upgrade error: %v", err)
+		fmt.Fprintf(p.logWriter, "WebSocket client upgrade error: %v\n", err)
 		return
 	}
 	defer clientConn.Close()
+	ws := &webSocketPair{remoteAddr: r.RemoteAddr, path: logPath, since: time.Now(), client: clientConn, upstream: upstreamConn}
+	p.flights.addWebSocket(ws)
+	defer p.flights.removeWebSocket(ws)
 
-	fmt.Fprintf(p.logWriter, "%s - - [%s] \"WS %s\" CONNECTED\n",
-		r.RemoteAddr, reqDate, r.URL.Path)
+	fmt.Fprintf(p.logWriter, "%s - %s [%s] \"WS %s\" CONNECTED\n",
+		r.RemoteAddr, logUser(ex.identity), reqDate, logPath)
 
 	// Bidirectional message copying
 	errChan := make(chan error, 2)
@@ -204,107 +555,391 @@ func (p *Proxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	<-errChan
 
 	closeDate := time.Now().Format("02/January/2006:15:04:05 -0700")
-	fmt.Fprintf(p.logWriter, "%s - - [%s] \"WS %s\" CLOSED\n",
-		r.RemoteAddr, closeDate, r.URL.Path)
+	fmt.Fprintf(p.logWriter, "%s - %s [%s] \"WS %s\" CLOSED\n",
+		r.RemoteAddr, logUser(ex.identity), closeDate, logPath)
 }
 
 func (p *Proxy) Start() error {
-	p.srv = http.Server{
-		Addr:         ":" + strconv.Itoa(p.port),
-		ReadTimeout:  0, // set to 0 in case client somehow took long time to upload the request
-		WriteTimeout: 0, // this must be bigger than upstream resp time, otherwise client got empty resp, so we set to 0
-		Handler:      p,
+	if err := p.Listen(); err != nil {
+		return err
 	}
-	return p.srv.ListenAndServe()
+	return p.Serve()
 }
 
-func (p *Proxy) Shutdown(ctx context.Context) {
-	p.srv.Shutdown(ctx)
+// SetListen changes the bind address & unix socket permission, taking effect on next start.
+func (p *Proxy) SetListen(listen string, socketMode os.FileMode) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.config.Listen = listen
+	p.config.SocketMode = socketMode
+}
+
+// Listen opens the port without serving it yet, so error like port already in use is known right away.
+func (p *Proxy) Listen() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.srv != nil {
+		return fmt.Errorf("port %d already started", p.config.Port)
+	}
+	network, address, err := listenAddress(p.config.Listen, p.config.Port)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    address,
+		Handler: p,
+	}
+	// none by default: client may take long time to upload the request, and Write must be bigger than
+	// upstream resp time, otherwise client got empty resp
+	p.config.Timeouts.configureServer(srv)
+	if err = configureServer(srv, p.config); err != nil {
+		return err
+	}
+	listener, err := listen(network, address, p.config.SocketMode)
+	if err != nil {
+		return err
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && p.config.Port == 0 {
+		// keep the port picked, so it's the same on restart & proxies are told apart by it
+		p.config.Port = addr.Port
+	}
+	if !p.logsOpen {
+		if err = p.openLogs(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	p.srv = srv
+	p.listener = listener
+	p.flights.reset()
+	return nil
+}
+
+// Serve blocks serving the port opened by Listen, until Shutdown is called.
+func (p *Proxy) Serve() error {
+	p.mutex.RLock()
+	srv, listener := p.srv, p.listener
+	p.mutex.RUnlock()
+	if srv == nil {
+		return fmt.Errorf("port %d not listening", p.config.Port)
+	}
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	p.mutex.Lock()
+	if p.srv == srv {
+		p.srv = nil
+	}
+	p.mutex.Unlock()
+	return err
+}
+
+// Addr returns the actual address listened to, e.g. the port picked for port 0, empty when not listening.
+func (p *Proxy) Addr() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.srv == nil {
+		return ""
+	}
+	addr := p.listener.Addr()
+	if addr.Network() == "unix" {
+		return unixPrefix + addr.String()
+	}
+	return addr.String()
+}
+
+// Running reports whether the proxy is listening.
+func (p *Proxy) Running() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.srv != nil
+}
 
+func (p *Proxy) Shutdown(ctx context.Context) {
+	p.mutex.Lock()
+	srv := p.srv
+	p.srv = nil
+	p.mutex.Unlock()
+	if srv != nil {
+		p.drain(ctx, srv)
+	}
+	if denied := p.access.Denied(); denied > 0 {
+		fmt.Fprintln(p.logWriter, "access lists denied", denied, "requests")
+	}
+	if len(p.logDir) > 0 && len(p.har.Entries()) > 0 {
+		if err := rotateLogFile(p.logDir, p.Port(), "har"); err != nil {
+			fmt.Fprintln(p.logWriter, err)
+		}
+		harFn := filepath.Join(p.logDir, fmt.Sprintf("%d.har", p.Port()))
+		if err := p.har.WriteFile(harFn); err != nil {
+			fmt.Fprintln(p.logWriter, "error writing har file", harFn, err)
+		}
+	}
 }
 
 func (p *Proxy) proxyDirector(req *http.Request) {
-	reqDump, err := httputil.DumpRequest(req, true)
-	if err != nil {
-		fmt.Println("error dumping req", req.URL)
+	ex := exchangeFrom(req.Context())
+	if isGRPC(req) {
+		// streams must not be read up front, they're captured as they pass through
+		if !ex.noLog {
+			p.captureGRPCRequest(ex, req)
+		}
+		p.rewriteURL(req, ex.settings.targetUrl)
+		p.hold(req, ex)
 		return
 	}
-	val := time.Now().UnixNano()
-	key := req.RemoteAddr + " " + req.Method + " " + req.RequestURI
-	p.reqTimeMap.Store(key, val)
-	req.Host = p.targetUrl.Host
-	req.URL.Scheme = p.targetUrl.Scheme
-	req.URL.Host = p.targetUrl.Host
-	req.URL.Path = p.targetUrl.Path + req.URL.Path
-
-	noLog := false
-	for _, rx := range p.noLog {
-		if rx.Match([]byte(req.RequestURI)) {
-			noLog = true
-			break
+	body, err := readBody(&req.Body)
+	if err != nil {
+		// req is left without target, so the transport fails it right away & proxyErrorHandler answers
+		ex.bodyErr = err
+		if isTimeout(err) {
+			p.logEvent(req, ex, fmt.Sprintf("\"%s %s\" timeout reading request body", req.Method, p.redact.URI(req.RequestURI)))
+		} else {
+			p.logEvent(req, ex, fmt.Sprintf("\"%s %s\" error reading request body: %v", req.Method, p.redact.URI(req.RequestURI), err))
 		}
+		return
 	}
-	if !noLog {
-		f, err := os.Create(fmt.Sprintf("%s/%d-req", p.logDirName, val))
-		if err != nil {
-			log.Println("error create req log:", err)
+	ex.reqBody = body
+	// copied as received, sent only once past hold, gate & breakpoints
+	mirrorCall := p.mirror.prepare(req, body)
+	var reqDump []byte
+	if !ex.noLog {
+		if reqDump, err = p.dumpRequest(req, body); err != nil {
+			fmt.Fprintln(p.logWriter, "error dumping req", p.redact.URI(req.RequestURI), err)
 			return
 		}
-		defer f.Close()
-		printReq(f, req)
-		fmt.Fprintf(f, string(reqDump))
+	}
+	p.rewriteURL(req, ex.settings.targetUrl)
+
+	if !ex.noLog {
+		p.writeReqDump(ex, req, reqDump)
 	}
 	hAcceptEnc := req.Header.Get("Accept-Encoding")
 	if strings.Contains(hAcceptEnc, "gzip") {
 		req.Header.Del("Accept-Encoding")
 	}
-	if p.hold > 0 {
-		time.Sleep(p.hold)
+	if p.hold(req, ex) && mirrorCall != nil {
+		ex.mirror = mirrorCall
+		p.mirror.send(mirrorCall)
+	}
+}
+
+// dumpRequest returns the redacted dump of req as received, before it's rewritten for upstream.
+func (p *Proxy) dumpRequest(req *http.Request, body []byte) ([]byte, error) {
+	redacted, dumpBody := p.redact.Request(req, body)
+	dumpReq := *redacted
+	dumpReq.Body = io.NopCloser(bytes.NewReader(dumpBody))
+	dumpReq.ContentLength = int64(len(dumpBody))
+	return httputil.DumpRequest(&dumpReq, true)
+}
+
+// writeReqDump writes the <id>-req file, summary of req as sent to upstream followed by reqDump.
+func (p *Proxy) writeReqDump(ex *exchange, req *http.Request, reqDump []byte) {
+	f := p.createDump(ex, "req")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	dumpReq, _ := p.redact.Request(req, nil)
+	printReq(f, dumpReq)
+	f.Write(reqDump)
+}
+
+func (p *Proxy) rewriteURL(req *http.Request, targetUrl *url.URL) {
+	req.Host = targetUrl.Host
+	req.URL.Scheme = targetUrl.Scheme
+	req.URL.Host = targetUrl.Host
+	req.URL.Path = targetUrl.Path + req.URL.Path
+}
+
+// hold delays req at the gate & for the hold duration. It returns false when the client went away meanwhile,
+// req must not be forwarded then, its context being done makes the transport fail right away anyway.
+func (p *Proxy) hold(req *http.Request, ex *exchange) bool {
+	if ex.settings.gated(req) && !p.waitGate(req, ex) {
+		ex.abandoned = true
+		return false
+	}
+	if hold := ex.settings.hold; hold > 0 {
+		timer := time.NewTimer(hold)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.flights.drained():
+			p.logEvent(req, ex, fmt.Sprintf("\"HOLD %s %s\" cut short by shutdown", req.Method, p.redact.URI(req.RequestURI)))
+		case <-req.Context().Done():
+			ex.abandoned = true
+			// the client side timeout is what's measured, so waited is since the request came in
+			p.logEvent(req, ex, fmt.Sprintf("\"HOLD %s %s\" client gone after %v of %v hold, not forwarded",
+				req.Method, p.redact.URI(req.RequestURI), time.Since(ex.start).Round(time.Millisecond), hold))
+			return false
+		}
+	}
+	ex.sent = time.Now()
+	p.flights.forwarded(ex)
+	return true
+}
+
+// readBody reads the whole body and replaces it with an in-memory copy, so it can still be forwarded.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
 	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, err
 }
 
 func (p *Proxy) proxyModifyResponse(resp *http.Response) error {
-	for _, rx := range p.noLog {
-		if rx.Match([]byte(resp.Request.RequestURI)) {
-			return nil
+	req := resp.Request
+	ex := exchangeFrom(req.Context())
+	if ex.settings.breaks(req, breakResponse) {
+		if err := p.breakResponse(ex, resp); err != nil {
+			return err
 		}
 	}
+	if ex.noLog && ex.mirror == nil {
+		return nil
+	}
+	if isGRPC(req) {
+		p.captureGRPCResponse(ex, resp)
+		return nil
+	}
 
-	var buf bytes.Buffer
-	body := io.TeeReader(resp.Body, &buf)
-	dumpResp := *resp
-	dumpResp.Body = io.NopCloser(body)
-	respDump, err := httputil.DumpResponse(&dumpResp, true)
+	body, err := readBody(&resp.Body)
 	if err != nil {
-		fmt.Println("error dumping resp", resp.Request.URL)
+		fmt.Fprintln(p.logWriter, "error reading resp", p.redact.URI(req.RequestURI), err)
 		return err
 	}
-	resp.Body = io.NopCloser(&buf)
-
-	req := resp.Request
-	key := req.RemoteAddr + " " + req.Method + " " + req.RequestURI
-	val, found := p.reqTimeMap.Load(key)
-	logResp(p.logWriter, resp, respDump, val.(int64))
-	if !found {
-		log.Println("request time not found")
+	if ex.mirror != nil {
+		p.compareMirror(ex, resp, body)
+	}
+	if ex.noLog {
 		return nil
 	}
-	f, err := os.Create(fmt.Sprintf("%s/%d-resp", p.logDirName, val))
+	return p.logResponse(ex, resp, body)
+}
+
+// logResponse writes the access log, HAR entry & <id>-resp file of resp, whose body is already read.
+func (p *Proxy) logResponse(ex *exchange, resp *http.Response, body []byte) error {
+	redacted, dumpBody := p.redact.Response(resp, body)
+	dumpResp := *redacted
+	dumpResp.Body = io.NopCloser(bytes.NewReader(dumpBody))
+	if dumpResp.ContentLength >= 0 {
+		dumpResp.ContentLength = int64(len(dumpBody))
+	}
+	respDump, err := httputil.DumpResponse(&dumpResp, true)
 	if err != nil {
-		log.Println("error create req log:", err)
+		fmt.Fprintln(p.logWriter, "error dumping resp", p.redact.URI(resp.Request.RequestURI), err)
+		return err
+	}
+
+	logResp(p.logWriter, &dumpResp, respDump, ex)
+	p.captureHar(ex, resp, body)
+	f := p.createDump(ex, "resp")
+	if f == nil {
 		return nil
 	}
 	defer f.Close()
-	printResp(f, resp)
-	fmt.Fprint(f, string(respDump))
+	printResp(f, &dumpResp)
+	f.Write(respDump)
 	return nil
 }
 
+func (p *Proxy) captureHar(ex *exchange, resp *http.Response, body []byte) {
+	p.addHar(p.harEntry(ex, resp, body))
+}
+
+// harEntry returns the redacted HAR entry of ex answered with resp & body.
+func (p *Proxy) harEntry(ex *exchange, resp *http.Response, body []byte) *harlog.Entry {
+	now := time.Now()
+	sent := ex.sent
+	if sent.IsZero() {
+		sent = ex.start
+	}
+	entry := &harlog.Entry{
+		ID:              strconv.FormatInt(ex.id, 10),
+		StartedDateTime: harlog.Time(ex.start),
+		Time:            harlog.Duration(now.Sub(ex.start)),
+		Request:         harlog.NewRequest(resp.Request, ex.reqBody),
+		Response:        harlog.NewResponse(resp, body),
+		Cache:           ex.cache.har(),
+		Comment:         ex.comment(),
+		Timings: &harlog.Timings{
+			Blocked: harlog.Duration(sent.Sub(ex.start)),
+			DNS:     -1,
+			Connect: -1,
+			Send:    0,
+			Wait:    harlog.Duration(now.Sub(sent)),
+			Receive: 0,
+			SSL:     -1,
+		},
+	}
+	p.redact.Entry(entry)
+	return entry
+}
+
+// addHar adds an already redacted entry to the HAR log & every capture sink.
+func (p *Proxy) addHar(entry *harlog.Entry) {
+	p.har.Add(entry)
+	for _, sink := range p.sinks {
+		sink.Capture(entry)
+	}
+}
+
+// createDump creates the <id>-<kind> dump file of ex, nil when dump files are off or it can't be created.
+func (p *Proxy) createDump(ex *exchange, kind string) *os.File {
+	if len(p.logDirName) == 0 {
+		return nil
+	}
+	f, err := os.Create(filepath.Join(p.logDirName, fmt.Sprintf("%d-%s", ex.id, kind)))
+	if err != nil {
+		fmt.Fprintf(p.logWriter, "error create %s log: %v\n", kind, err)
+		return nil
+	}
+	return f
+}
+
+// readDump reads the dump files of exchange id.
+func (p *Proxy) readDump(id int64) (*Dump, error) {
+	if len(p.logDirName) == 0 {
+		return nil, errors.New("dump files are off")
+	}
+	return ReadDump(p.logDirName, id)
+}
+
+// logEvent writes an access log line about ex other than its response, e.g. it's paused at a breakpoint.
+func (p *Proxy) logEvent(req *http.Request, ex *exchange, msg string) {
+	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
+	fmt.Fprintf(p.logWriter, "%s - %s [%s] %s %d\n", req.RemoteAddr, logUser(ex.identity), reqDate, msg, ex.id)
+}
+
 func (p *Proxy) proxyErrorHandler(writer http.ResponseWriter, req *http.Request, err error) {
-	format := "%s - - [%s] \"%s %s %s\"\n"
+	ex := exchangeFrom(req.Context())
+	if ex.abandoned {
+		// logged by hold already
+		return
+	}
+	if ex.bodyErr != nil {
+		// logged by proxyDirector already
+		writer.WriteHeader(bodyErrorStatus(ex.bodyErr))
+		return
+	}
+	if ex.mirror != nil {
+		p.mirrorUpstreamError(ex, req, err)
+	}
+	if phase := timeoutPhase(err); len(phase) > 0 {
+		p.logRejected(req, http.StatusGatewayTimeout, fmt.Sprintf("timeout %s %d", phase, ex.id))
+		writer.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	format := "%s - %s [%s] \"%s %s %s\"\n"
 	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
 	f := p.logWriter
-	fmt.Fprintf(f, format, req.RemoteAddr, reqDate, req.Method, req.RequestURI, req.Proto)
+	fmt.Fprintf(f, format, req.RemoteAddr, logUser(ex.identity), reqDate, req.Method, p.redact.URI(req.RequestURI), req.Proto)
 }
 
 func printReq(f *os.File, r *http.Request) {
@@ -321,13 +956,18 @@ func printResp(f *os.File, r *http.Response) {
 	}
 }
 
-func logResp(f io.Writer, resp *http.Response, data []byte, timestamp int64) {
+func logResp(f io.Writer, resp *http.Response, data []byte, ex *exchange) {
 	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
 	req := resp.Request
 	reqHost := req.URL.Scheme + "://" + req.URL.Host
-	format := "%s - - [%s] \"%s %s %s\" %d %d \"%s\" %d\n"
+	// req.Proto is the client protocol, resp.Proto the upstream one, followed by cache status if any
+	format := "%s - %s [%s] \"%s %s %s\" %d %d \"%s\" %d %s%s\n"
+	cacheStatus := ""
+	if ex.cache != nil {
+		cacheStatus = " " + ex.cache.status
+	}
 	//log.Println("requestURI:", req.RequestURI, req.URL)
-	_, err := fmt.Fprintf(f, format, req.RemoteAddr, reqDate, req.Method, req.RequestURI, req.Proto, resp.StatusCode, len(data), reqHost, timestamp)
+	_, err := fmt.Fprintf(f, format, req.RemoteAddr, logUser(ex.identity), reqDate, req.Method, req.RequestURI, req.Proto, resp.StatusCode, len(data), reqHost, ex.id, resp.Proto, cacheStatus)
 	if err != nil {
 		log.Println("error logging:", err)
 	}
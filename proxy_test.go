@@ -0,0 +1,63 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_Hold(t *testing.T) {
+	var log bytes.Buffer
+	p := &Proxy{logWriter: &log}
+	settings := &proxySettings{hold: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ex := &exchange{id: 1, start: time.Now(), settings: settings}
+	if p.hold(httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx), ex) {
+		t.Fatal("hold forwarded the request of a client gone")
+	}
+	if !ex.abandoned || !ex.sent.IsZero() {
+		t.Errorf("exchange got abandoned %v, sent %v", ex.abandoned, ex.sent)
+	}
+	if !strings.Contains(log.String(), `"HOLD GET /slow" client gone after 5`) || !strings.Contains(log.String(), "of 1m0s hold, not forwarded") {
+		t.Errorf("log got %q", log.String())
+	}
+
+	ex = &exchange{id: 2, start: time.Now(), settings: &proxySettings{hold: 10 * time.Millisecond}}
+	if !p.hold(httptest.NewRequest(http.MethodGet, "/slow", nil), ex) || ex.sent.Sub(ex.start) < 10*time.Millisecond {
+		t.Errorf("hold got sent after %v, want 10ms", ex.sent.Sub(ex.start))
+	}
+}
+
+func TestProxy_Update(t *testing.T) {
+	p, err := New(WithTarget("http://localhost:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := p.Config()
+	config.Target = "http://localhost:2"
+	config.Hold = time.Second
+	config.Breakpoints = []BreakpointConfig{{Path: "("}}
+	if err = p.Update(config); err == nil {
+		t.Fatal("Update with invalid breakpoint got no error")
+	}
+	if got := p.Config(); got.Target != "http://localhost:1" || got.Hold != 0 {
+		t.Errorf("invalid update got applied partly: %+v", got)
+	}
+
+	config.Breakpoints = []BreakpointConfig{{Path: "^/orders"}}
+	config.NoLog = []string{"^/health"}
+	config.Listen = "127.0.0.1"
+	if err = p.Update(config); err != nil {
+		t.Fatal(err)
+	}
+	got := p.Config()
+	if got.Target != "http://localhost:2" || got.Hold != time.Second || len(got.NoLog) != 1 || len(got.Breakpoints) != 1 || got.Listen != "127.0.0.1" {
+		t.Errorf("Update got %+v", got)
+	}
+}
@@ -0,0 +1,447 @@
+package hdproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+const (
+	RedactModeMask = "mask"
+	RedactModeHash = "hash"
+
+	redactMask = "REDACTED"
+)
+
+type (
+	// RedactConfig lists what should be hidden from every capture sink (dump files, access log, HAR).
+	RedactConfig struct {
+		// Headers names, case insensitive.
+		Headers []string
+		// Cookies names, applied to both Cookie and Set-Cookie headers.
+		Cookies []string
+		// Query parameter names, also applied to url encoded form bodies.
+		Query []string
+		// JSON field paths separated by dots, "*" matches any single key or array element, numbers match array index,
+		// "**" matches any number of levels, e.g. "user.password", "cards.*.number", "**.token".
+		JSON []string
+		// Patterns are regexes applied to all captured text, e.g. card numbers or emails.
+		Patterns []string
+		// Mode is either "mask" (default) to replace values with a fixed marker,
+		// or "hash" to replace them with a short keyed hash (HMAC-SHA256) so equal values stay recognizable.
+		Mode string
+		// HashKey is the key of "hash" mode, random per process when empty.
+		// Equal values only hash the same with the same key, set it to compare captures across restarts.
+		HashKey string
+	}
+
+	Redactor struct {
+		headers  map[string]bool
+		cookies  map[string]bool
+		query    map[string]bool
+		json     [][]string
+		patterns []*regexp.Regexp
+		hashKey  []byte
+	}
+)
+
+// redactHashKey is the key of "hash" mode when none is configured, so hashes can't be brute-forced offline.
+var redactHashKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprint("hdproxy: can't generate redact hash key: ", err))
+	}
+	return key
+}()
+
+// NewRedactor compiles config into a Redactor, it returns nil when there is nothing to redact.
+// All Redactor methods are safe to call on nil.
+func NewRedactor(config RedactConfig) (*Redactor, error) {
+	r := &Redactor{
+		headers: make(map[string]bool),
+		cookies: make(map[string]bool),
+		query:   make(map[string]bool),
+	}
+	switch strings.ToLower(strings.TrimSpace(config.Mode)) {
+	case "", RedactModeMask:
+	case RedactModeHash:
+		r.hashKey = redactHashKey
+		if len(config.HashKey) > 0 {
+			r.hashKey = []byte(config.HashKey)
+		}
+	default:
+		return nil, fmt.Errorf("invalid redact mode %q", config.Mode)
+	}
+	for _, name := range config.Headers {
+		r.headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	for _, name := range config.Cookies {
+		r.cookies[strings.TrimSpace(name)] = true
+	}
+	for _, name := range config.Query {
+		r.query[strings.TrimSpace(name)] = true
+	}
+	for _, path := range config.JSON {
+		path = strings.TrimSpace(path)
+		if len(path) > 0 {
+			r.json = append(r.json, strings.Split(path, "."))
+		}
+	}
+	for _, pattern := range config.Patterns {
+		rx, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, rx)
+	}
+	if len(r.headers)+len(r.cookies)+len(r.query)+len(r.json)+len(r.patterns) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *Redactor) value(v string) string {
+	if r.hashKey == nil {
+		return redactMask
+	}
+	return r.hash(v)
+}
+
+// hash returns the keyed hash of v whatever the mode, for values that are never shown but should stay recognizable.
+func (r *Redactor) hash(v string) string {
+	key := redactHashKey
+	if r != nil && r.hashKey != nil {
+		key = r.hashKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(v))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// Text applies the regex patterns to b.
+func (r *Redactor) Text(b []byte) []byte {
+	if r == nil {
+		return b
+	}
+	for _, rx := range r.patterns {
+		b = rx.ReplaceAllFunc(b, func(m []byte) []byte {
+			return []byte(r.value(string(m)))
+		})
+	}
+	return b
+}
+
+// String is Text for strings.
+func (r *Redactor) String(s string) string {
+	if r == nil || len(r.patterns) == 0 {
+		return s
+	}
+	return string(r.Text([]byte(s)))
+}
+
+// Header returns a redacted copy of h.
+func (r *Redactor) Header(h http.Header) http.Header {
+	if r == nil {
+		return h
+	}
+	result := make(http.Header, len(h))
+	for k, vs := range h {
+		values := make([]string, len(vs))
+		for i, v := range vs {
+			switch {
+			case r.headers[http.CanonicalHeaderKey(k)]:
+				v = r.value(v)
+			case strings.EqualFold(k, "Cookie"):
+				v = r.cookieHeader(v)
+			case strings.EqualFold(k, "Set-Cookie"):
+				v = r.setCookieHeader(v)
+			}
+			values[i] = r.String(v)
+		}
+		result[k] = values
+	}
+	return result
+}
+
+func (r *Redactor) cookieHeader(v string) string {
+	if len(r.cookies) == 0 {
+		return v
+	}
+	parts := strings.Split(v, ";")
+	for i, part := range parts {
+		name, value, found := strings.Cut(part, "=")
+		if found && r.cookies[strings.TrimSpace(name)] {
+			parts[i] = name + "=" + r.value(value)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func (r *Redactor) setCookieHeader(v string) string {
+	if len(r.cookies) == 0 {
+		return v
+	}
+	pair, attrs, _ := strings.Cut(v, ";")
+	name, value, found := strings.Cut(pair, "=")
+	if !found || !r.cookies[strings.TrimSpace(name)] {
+		return v
+	}
+	result := name + "=" + r.value(value)
+	if len(attrs) > 0 {
+		result += ";" + attrs
+	}
+	return result
+}
+
+// Query redacts the configured parameters in a raw (still encoded) query string.
+// The query is edited in place instead of re-encoded, so the rest of it stays exactly as received.
+func (r *Redactor) Query(rawQuery string) string {
+	if r == nil || len(rawQuery) == 0 {
+		return rawQuery
+	}
+	if len(r.query) > 0 {
+		parts := strings.Split(rawQuery, "&")
+		for i, part := range parts {
+			name, value, found := strings.Cut(part, "=")
+			if !found {
+				continue
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil && r.query[unescaped] {
+				parts[i] = name + "=" + r.value(value)
+			}
+		}
+		rawQuery = strings.Join(parts, "&")
+	}
+	return r.String(rawQuery)
+}
+
+// URI redacts a request URI, e.g. http.Request.RequestURI or an absolute URL.
+func (r *Redactor) URI(uri string) string {
+	if r == nil {
+		return uri
+	}
+	path, query, found := strings.Cut(uri, "?")
+	if !found {
+		return r.String(uri)
+	}
+	return r.String(path) + "?" + r.Query(query)
+}
+
+// Body redacts JSON fields and form parameters depending on contentType, then applies the patterns.
+func (r *Redactor) Body(contentType string, body []byte) []byte {
+	if r == nil || len(body) == 0 {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return []byte(r.Query(string(body)))
+	case len(r.json) > 0 && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")):
+		body = r.jsonBody(body)
+	}
+	return r.Text(body)
+}
+
+// jsonBody redacts the JSON fields in place, the rest of body is kept byte for byte so it still matches the wire.
+func (r *Redactor) jsonBody(body []byte) []byte {
+	if !json.Valid(body) {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var edits []jsonEdit
+	if err := r.jsonValue(decoder, body, nil, &edits); err != nil || len(edits) == 0 {
+		return body
+	}
+	var result bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		result.Write(body[last:e.start])
+		result.WriteString(e.value)
+		last = e.end
+	}
+	result.Write(body[last:])
+	return result.Bytes()
+}
+
+// jsonEdit replaces body[start:end] with value.
+type jsonEdit struct {
+	start, end int
+	value      string
+}
+
+// jsonValue reads the value at path from decoder, adding an edit for it or for its children matching r.json.
+// Edits come in body order.
+func (r *Redactor) jsonValue(decoder *json.Decoder, body []byte, path []string, edits *[]jsonEdit) error {
+	start := jsonValueStart(body, int(decoder.InputOffset()))
+	if r.jsonMatches(path) {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			// not a string, the whole value is redacted as compact JSON
+			var compact bytes.Buffer
+			json.Compact(&compact, raw)
+			s = compact.String()
+		}
+		value, _ := json.Marshal(r.value(s))
+		*edits = append(*edits, jsonEdit{start: start, end: int(decoder.InputOffset()), value: string(value)})
+		return nil
+	}
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if err = r.jsonValue(decoder, body, append(path[:len(path):len(path)], key.(string)), edits); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			if err = r.jsonValue(decoder, body, append(path[:len(path):len(path)], strconv.Itoa(i)), edits); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	}
+	return err
+}
+
+// jsonValueStart skips the whitespace & separators before the value starting after offset.
+func jsonValueStart(body []byte, offset int) int {
+	for offset < len(body) {
+		switch body[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// jsonMatches reports whether path matches any of the JSON paths to redact.
+func (r *Redactor) jsonMatches(path []string) bool {
+	for _, pattern := range r.json {
+		if matchJSONPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchJSONPath matches path against pattern, "*" matches any single key, "**" any number of them.
+func matchJSONPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		return matchJSONPath(pattern[1:], path) || len(path) > 0 && matchJSONPath(pattern, path[1:])
+	}
+	return len(path) > 0 && (pattern[0] == "*" || pattern[0] == path[0]) && matchJSONPath(pattern[1:], path[1:])
+}
+
+// Request returns a redacted shallow copy of req along with its redacted body.
+func (r *Redactor) Request(req *http.Request, body []byte) (*http.Request, []byte) {
+	if r == nil {
+		return req, body
+	}
+	result := *req
+	u := *req.URL
+	u.RawQuery = r.Query(u.RawQuery)
+	result.URL = &u
+	result.RequestURI = r.URI(req.RequestURI)
+	result.Header = r.Header(req.Header)
+	return &result, r.Body(req.Header.Get("Content-Type"), body)
+}
+
+// Response returns a redacted shallow copy of resp along with its redacted body.
+func (r *Redactor) Response(resp *http.Response, body []byte) (*http.Response, []byte) {
+	if r == nil {
+		return resp, body
+	}
+	result := *resp
+	result.Header = r.Header(resp.Header)
+	if resp.Request != nil {
+		result.Request, _ = r.Request(resp.Request, nil)
+	}
+	return &result, r.Body(resp.Header.Get("Content-Type"), body)
+}
+
+// Entry redacts a HAR entry in place.
+func (r *Redactor) Entry(e *harlog.Entry) {
+	if r == nil || e == nil {
+		return
+	}
+	if req := e.Request; req != nil {
+		req.URL = r.URI(req.URL)
+		req.Headers = r.nvps(req.Headers, r.headerValue)
+		req.Cookies = r.harCookies(req.Cookies)
+		req.QueryString = r.nvps(req.QueryString, r.queryValue)
+		if pd := req.PostData; pd != nil {
+			pd.Text = string(r.Body(pd.MimeType, []byte(pd.Text)))
+			for _, p := range pd.Params {
+				p.Value = r.queryValue(p.Name, p.Value)
+			}
+		}
+	}
+	if resp := e.Response; resp != nil {
+		resp.Headers = r.nvps(resp.Headers, r.headerValue)
+		resp.Cookies = r.harCookies(resp.Cookies)
+		resp.RedirectURL = r.URI(resp.RedirectURL)
+		if c := resp.Content; c != nil && len(c.Encoding) == 0 {
+			c.Text = string(r.Body(c.MimeType, []byte(c.Text)))
+		}
+	}
+}
+
+func (r *Redactor) headerValue(name, value string) string {
+	h := r.Header(http.Header{name: {value}})
+	return h[name][0]
+}
+
+func (r *Redactor) queryValue(name, value string) string {
+	if r.query[name] {
+		return r.value(value)
+	}
+	return r.String(value)
+}
+
+func (r *Redactor) nvps(nvps []*harlog.NVP, fn func(name, value string) string) []*harlog.NVP {
+	for _, nvp := range nvps {
+		nvp.Value = fn(nvp.Name, nvp.Value)
+	}
+	return nvps
+}
+
+func (r *Redactor) harCookies(cookies []*harlog.Cookie) []*harlog.Cookie {
+	for _, c := range cookies {
+		if r.cookies[c.Name] {
+			c.Value = r.value(c.Value)
+		} else {
+			c.Value = r.String(c.Value)
+		}
+	}
+	return cookies
+}
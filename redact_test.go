@@ -0,0 +1,178 @@
+package hdproxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedactor_Query(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RedactConfig
+		query  string
+		want   string
+	}{
+		{
+			name:   "mask",
+			config: RedactConfig{Query: []string{"token"}},
+			query:  "a=1&token=secret&b=2",
+			want:   "a=1&token=REDACTED&b=2",
+		},
+		{
+			name:   "hash",
+			config: RedactConfig{Query: []string{"token"}, Mode: RedactModeHash, HashKey: "key"},
+			query:  "token=secret",
+			want:   "token=hmac:25cf3c44c8f3",
+		},
+		{
+			name:   "pattern",
+			config: RedactConfig{Patterns: []string{`[\w.]+@[\w.]+`}},
+			query:  "email=me@example.com",
+			want:   "email=REDACTED",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Query(tt.query); got != tt.want {
+				t.Errorf("Query() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactor_HashKey(t *testing.T) {
+	hash := func(key string) string {
+		r, err := NewRedactor(RedactConfig{Query: []string{"token"}, Mode: RedactModeHash, HashKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Query("token=secret")
+	}
+	if random := hash(""); random != hash("") {
+		t.Errorf("random key changed within process: %s, %s", random, hash(""))
+	} else if random == hash("key") || !regexp.MustCompile(`^token=hmac:[0-9a-f]{12}$`).MatchString(random) {
+		t.Errorf("random key hash got %s", random)
+	}
+	if hash("a") == hash("b") {
+		t.Error("different keys got the same hash")
+	}
+}
+
+func TestRedactor_Header(t *testing.T) {
+	r, err := NewRedactor(RedactConfig{
+		Headers: []string{"authorization"},
+		Cookies: []string{"session"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{
+		"Authorization": {"Bearer abc"},
+		"Cookie":        {"theme=dark; session=abc"},
+		"Set-Cookie":    {"session=abc; Path=/; HttpOnly"},
+		"Accept":        {"*/*"},
+	}
+	got := r.Header(h)
+	want := http.Header{
+		"Authorization": {"REDACTED"},
+		"Cookie":        {"theme=dark; session=REDACTED"},
+		"Set-Cookie":    {"session=REDACTED; Path=/; HttpOnly"},
+		"Accept":        {"*/*"},
+	}
+	for k := range want {
+		if got.Get(k) != want.Get(k) {
+			t.Errorf("Header() %s got = %v, want %v", k, got.Get(k), want.Get(k))
+		}
+	}
+	if h.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Header() modified the original header")
+	}
+}
+
+func TestRedactor_Body(t *testing.T) {
+	tests := []struct {
+		name        string
+		paths       []string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "plain path",
+			paths:       []string{"user.password"},
+			contentType: "application/json",
+			body:        `{"user":{"name":"a","password":"b"}}`,
+			want:        `{"user":{"name":"a","password":"REDACTED"}}`,
+		},
+		{
+			name:        "array wildcard",
+			paths:       []string{"cards.*.number"},
+			contentType: "application/json; charset=utf-8",
+			body:        `{"cards":[{"number":"4111"},{"number":4222}]}`,
+			want:        `{"cards":[{"number":"REDACTED"},{"number":"REDACTED"}]}`,
+		},
+		{
+			name:        "any depth",
+			paths:       []string{"**.token"},
+			contentType: "application/json",
+			body:        `{"token":"a","x":[{"y":{"token":"b"}}]}`,
+			want:        `{"token":"REDACTED","x":[{"y":{"token":"REDACTED"}}]}`,
+		},
+		{
+			name:        "kept as sent",
+			paths:       []string{"b.secret"},
+			contentType: "application/json",
+			body:        "{\"z\": 1.50, \"a\": \"<a&b>\",\n \"b\": {\"secret\": {\"x\": 1}, \"n\": 1e3}}",
+			want:        "{\"z\": 1.50, \"a\": \"<a&b>\",\n \"b\": {\"secret\": \"REDACTED\", \"n\": 1e3}}",
+		},
+		{
+			name:        "untouched",
+			paths:       []string{"password"},
+			contentType: "application/json",
+			body:        `{ "name": "a" }`,
+			want:        `{ "name": "a" }`,
+		},
+		{
+			name:        "not json",
+			paths:       []string{"password"},
+			contentType: "text/plain",
+			body:        `{"password":"a"}`,
+			want:        `{"password":"a"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(RedactConfig{JSON: tt.paths})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(r.Body(tt.contentType, []byte(tt.body))); got != tt.want {
+				t.Errorf("Body() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactConfig{})
+	if err != nil || r != nil {
+		t.Errorf("NewRedactor() empty config got = %v, %v, want nil, nil", r, err)
+	}
+	if got := r.URI("/a?b=c"); got != "/a?b=c" {
+		t.Errorf("nil Redactor URI() got = %v", got)
+	}
+	_, err = NewRedactor(RedactConfig{Patterns: []string{"("}})
+	if err == nil || !strings.Contains(err.Error(), "invalid redact pattern") {
+		t.Errorf("NewRedactor() invalid pattern got err = %v", err)
+	}
+	_, err = NewRedactor(RedactConfig{Headers: []string{"a"}, Mode: "blur"})
+	if err == nil {
+		t.Errorf("NewRedactor() invalid mode got no error")
+	}
+}
@@ -0,0 +1,133 @@
+package hdproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siroj100/hdproxy/harlog"
+)
+
+// replayRemoteAddr is the client address of replayed requests in the access log.
+const replayRemoteAddr = "replay"
+
+type (
+	// ReplayEdits are changes applied to a captured request before it's sent again.
+	ReplayEdits struct {
+		// Target replaces the proxy target for this request only, e.g. "http://localhost:9000".
+		Target string `json:"target,omitempty"`
+		Method string `json:"method,omitempty"`
+		// Headers are set, replacing any value the request had, DelHeaders removed.
+		Headers    map[string]string `json:"headers,omitempty"`
+		DelHeaders []string          `json:"delHeaders,omitempty"`
+		// Query parameters are set, replacing any value the request had, DelQuery removed.
+		Query    map[string]string `json:"query,omitempty"`
+		DelQuery []string          `json:"delQuery,omitempty"`
+		// Body replaces the request body when not nil.
+		Body *string `json:"body,omitempty"`
+	}
+
+	// ReplayResult is the outcome of a replay, Entry is nil when the exchange isn't logged.
+	ReplayResult struct {
+		ID       string        `json:"id"`
+		ReplayOf string        `json:"replayOf"`
+		Status   int           `json:"status"`
+		Entry    *harlog.Entry `json:"entry,omitempty"`
+	}
+)
+
+// comment is the HAR comment of the exchange, linking replay to its original.
+func (ex *exchange) comment() string {
+	if ex.replayOf == 0 {
+		return ""
+	}
+	return fmt.Sprintf("replay of %d", ex.replayOf)
+}
+
+// Replay sends the request of captured exchange id again through the proxy, with edits applied.
+// The client side checks (access lists, rate limits, auth gate) are skipped, the caller is trusted.
+func (p *Proxy) Replay(ctx context.Context, id int64, edits ReplayEdits) (*ReplayResult, error) {
+	d, err := p.readDump(id)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %d not found: %w", id, err)
+	}
+	if isGRPC(d.Request) {
+		return nil, fmt.Errorf("gRPC calls can't be replayed, their dump holds decoded messages")
+	}
+	settings, err := p.settings().withTarget(edits.Target)
+	if err != nil {
+		return nil, err
+	}
+	req, err := replayRequest(ctx, d, edits)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := p.newExchange(req, replayRemoteAddr, settings)
+	ex.replayOf = id
+	w := httptest.NewRecorder()
+	p.serveExchange(w, req, ex)
+
+	reqDate := time.Now().Format("02/January/2006:15:04:05 -0700")
+	fmt.Fprintf(p.logWriter, "%s - - [%s] \"REPLAY %s %s\" %d %d -> %d\n",
+		replayRemoteAddr, reqDate, req.Method, p.redact.URI(req.RequestURI), w.Code, id, ex.id)
+	result := &ReplayResult{ID: strconv.FormatInt(ex.id, 10), ReplayOf: strconv.FormatInt(id, 10), Status: w.Code}
+	for _, e := range p.har.Entries() {
+		if e.ID == result.ID {
+			result.Entry = e
+		}
+	}
+	return result, nil
+}
+
+// replayRequest rebuilds the request of d as the proxy received it, with edits applied.
+func replayRequest(ctx context.Context, d *Dump, edits ReplayEdits) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, d.Request.Method, d.Request.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = replayRemoteAddr
+	req.Host = d.Request.Host
+	req.Header = d.Request.Header.Clone()
+	edits.apply(req, d.RequestBody)
+	return req, nil
+}
+
+// apply edits req in place, including its body which is replaced by an in-memory one, returned.
+// Target is left to the caller, see proxySettings.withTarget.
+func (e ReplayEdits) apply(req *http.Request, body []byte) []byte {
+	if e.Body != nil {
+		body = []byte(*e.Body)
+	}
+	if len(e.Method) > 0 {
+		req.Method = strings.ToUpper(e.Method)
+	}
+	if len(e.Query) > 0 || len(e.DelQuery) > 0 {
+		query := req.URL.Query()
+		for name, value := range e.Query {
+			query.Set(name, value)
+		}
+		for _, name := range e.DelQuery {
+			query.Del(name)
+		}
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	for _, name := range e.DelHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Del("Content-Length")
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
@@ -0,0 +1,62 @@
+package hdproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReplayRequest(t *testing.T) {
+	captured, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"POST /orders?x=1&y=2 HTTP/1.1\r\nHost: localhost:8080\r\nContent-Type: application/json\r\nX-Trace: abc\r\nContent-Length: 8\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Dump{ID: 1, Request: captured, RequestBody: []byte(`{"id":1}`)}
+	newBody := `{"id":2}`
+	tests := []struct {
+		name       string
+		edits      ReplayEdits
+		wantMethod string
+		wantURI    string
+		wantHeader http.Header
+		wantBody   string
+	}{
+		{"as captured", ReplayEdits{}, "POST", "/orders?x=1&y=2",
+			http.Header{"Content-Type": {"application/json"}, "X-Trace": {"abc"}}, `{"id":1}`},
+		{"edited", ReplayEdits{
+			Method:     "put",
+			Headers:    map[string]string{"x-trace": "def", "X-New": "1"},
+			DelHeaders: []string{"Content-Type"},
+			Query:      map[string]string{"x": "3"},
+			DelQuery:   []string{"y"},
+			Body:       &newBody,
+		}, "PUT", "/orders?x=3", http.Header{"X-Trace": {"def"}, "X-New": {"1"}}, `{"id":2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := replayRequest(context.Background(), d, tt.edits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != tt.wantMethod || req.RequestURI != tt.wantURI || req.Host != "localhost:8080" {
+				t.Errorf("got %s %s host %s", req.Method, req.RequestURI, req.Host)
+			}
+			if len(req.Header) != len(tt.wantHeader) {
+				t.Errorf("header got %v, want %v", req.Header, tt.wantHeader)
+			}
+			for name := range tt.wantHeader {
+				if req.Header.Get(name) != tt.wantHeader.Get(name) {
+					t.Errorf("header %s got %q, want %q", name, req.Header.Get(name), tt.wantHeader.Get(name))
+				}
+			}
+			body, _ := io.ReadAll(req.Body)
+			if string(body) != tt.wantBody || req.ContentLength != int64(len(tt.wantBody)) {
+				t.Errorf("body got %q (%d), want %q", body, req.ContentLength, tt.wantBody)
+			}
+		})
+	}
+}
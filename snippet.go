@@ -0,0 +1,102 @@
+package hdproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Snippet formats, see FormatSnippet.
+const (
+	SnippetCurl   = "curl"
+	SnippetHTTPie = "httpie"
+	SnippetHTTP   = "http" // VS Code REST Client & JetBrains HTTP client
+)
+
+// snippetSkippedHeaders are set by the client running the snippet.
+var snippetSkippedHeaders = map[string]bool{"Content-Length": true, "Connection": true, "Transfer-Encoding": true, "Host": true}
+
+// FormatSnippet writes the request of d in format, redacted by r, r can be nil.
+func FormatSnippet(w io.Writer, format string, d *Dump, r *Redactor) error {
+	req, body := r.Request(d.Request, d.RequestBody)
+	u := *d.URL
+	u.RawQuery = r.Query(u.RawQuery)
+	target := u.String()
+	var names []string
+	for name := range req.Header {
+		if !snippetSkippedHeaders[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	binary := !utf8.Valid(body)
+
+	var lines []string
+	switch strings.ToLower(format) {
+	case SnippetCurl:
+		cmd := "curl"
+		if binary {
+			cmd = "echo " + base64.StdEncoding.EncodeToString(body) + " | base64 -d | curl"
+		}
+		// curl turns GET into POST when there's a body, & waits for a body after -X HEAD
+		switch {
+		case req.Method == http.MethodHead:
+			cmd += " -I"
+		case req.Method != http.MethodGet || len(body) > 0:
+			cmd += " -X " + req.Method
+		}
+		lines = append(lines, cmd+" "+shellQuote(target))
+		for _, name := range names {
+			for _, value := range req.Header[name] {
+				lines = append(lines, "-H "+shellQuote(name+": "+value))
+			}
+		}
+		switch {
+		case binary:
+			lines = append(lines, "--data-binary @-")
+		case len(body) > 0:
+			lines = append(lines, "--data-raw "+shellQuote(string(body)))
+		}
+		fmt.Fprintln(w, strings.Join(lines, " \\\n  "))
+	case SnippetHTTPie:
+		cmd := "http"
+		if binary {
+			cmd = "echo " + base64.StdEncoding.EncodeToString(body) + " | base64 -d | http"
+		}
+		lines = append(lines, cmd+" "+req.Method+" "+shellQuote(target))
+		for _, name := range names {
+			for _, value := range req.Header[name] {
+				lines = append(lines, shellQuote(name+":"+value))
+			}
+		}
+		if !binary && len(body) > 0 {
+			lines = append(lines, "--raw "+shellQuote(string(body)))
+		}
+		fmt.Fprintln(w, strings.Join(lines, " \\\n  "))
+	case SnippetHTTP:
+		fmt.Fprintf(w, "### %d\n%s %s\n", d.ID, req.Method, target)
+		for _, name := range names {
+			for _, value := range req.Header[name] {
+				fmt.Fprintf(w, "%s: %s\n", name, value)
+			}
+		}
+		switch {
+		case binary:
+			fmt.Fprintf(w, "\n# binary body of %d bytes left out\n", len(body))
+		case len(body) > 0:
+			fmt.Fprintf(w, "\n%s\n", body)
+		}
+	default:
+		return fmt.Errorf("invalid format %q, expecting curl, httpie or http", format)
+	}
+	return nil
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,69 @@
+package hdproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestFormatSnippet(t *testing.T) {
+	u, _ := url.Parse("http://example.com/api/orders?x=1&token=abc")
+	req, _ := http.NewRequest(http.MethodPost, "/orders?x=1&token=abc", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", "25")
+	req.Header.Set("Authorization", "Bearer secret")
+	d := &Dump{ID: 1700000000000000000, URL: u, Request: req, RequestBody: []byte(`{"id":1,"note":"it's"}`)}
+	r, err := NewRedactor(RedactConfig{Headers: []string{"Authorization"}, Query: []string{"token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		format string
+		dump   *Dump
+		want   string
+	}{
+		{SnippetCurl, d, `curl -X POST 'http://example.com/api/orders?x=1&token=REDACTED' \
+  -H 'Authorization: REDACTED' \
+  -H 'Content-Type: application/json' \
+  --data-raw '{"id":1,"note":"it'\''s"}'
+`},
+		{SnippetHTTPie, d, `http POST 'http://example.com/api/orders?x=1&token=REDACTED' \
+  'Authorization:REDACTED' \
+  'Content-Type:application/json' \
+  --raw '{"id":1,"note":"it'\''s"}'
+`},
+		{SnippetHTTP, d, `### 1700000000000000000
+POST http://example.com/api/orders?x=1&token=REDACTED
+Authorization: REDACTED
+Content-Type: application/json
+
+{"id":1,"note":"it's"}
+`},
+		{SnippetCurl, &Dump{URL: u, Request: &http.Request{Method: http.MethodPut, URL: u, Header: http.Header{}}, RequestBody: []byte{0xff, 0}},
+			`echo /wA= | base64 -d | curl -X PUT 'http://example.com/api/orders?x=1&token=REDACTED' \
+  --data-binary @-
+`},
+		{SnippetCurl, &Dump{URL: u, Request: &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}, RequestBody: []byte(`{"q":1}`)},
+			`curl -X GET 'http://example.com/api/orders?x=1&token=REDACTED' \
+  --data-raw '{"q":1}'
+`},
+		{SnippetCurl, &Dump{URL: u, Request: &http.Request{Method: http.MethodHead, URL: u, Header: http.Header{}}},
+			`curl -I 'http://example.com/api/orders?x=1&token=REDACTED'
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := FormatSnippet(&buf, tt.format, tt.dump, r); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("FormatSnippet got\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+	if err := FormatSnippet(&bytes.Buffer{}, "wget", d, nil); err == nil {
+		t.Error("FormatSnippet accepted invalid format")
+	}
+}
@@ -0,0 +1,152 @@
+package hdproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultWebSocketHandshake is used when TimeoutsConfig.WebSocketHandshake is not set.
+const defaultWebSocketHandshake = 10 * time.Second
+
+// Phases reported by timeoutPhase.
+const (
+	phaseDial           = "dial"
+	phaseTLSHandshake   = "tls handshake"
+	phaseResponseHeader = "response header"
+	phaseUpstream       = "upstream"
+)
+
+type (
+	// TimeoutsConfig are the timeouts of a proxy, 0 means none on the listener & Go's defaults upstream.
+	TimeoutsConfig struct {
+		// ReadHeader, Read, Write & Idle apply to client connections, as in http.Server.
+		// Write also cuts short responses slower than it, so keep it above the upstream response time & Hold.
+		ReadHeader time.Duration
+		Read       time.Duration
+		Write      time.Duration
+		Idle       time.Duration
+		// Dial, TLSHandshake, ResponseHeader & UpstreamIdle apply to upstream connections, as in http.Transport,
+		// HTTP/2 upstream (UpstreamProtocol="http2" & gRPC) included.
+		Dial           time.Duration
+		TLSHandshake   time.Duration
+		ResponseHeader time.Duration
+		UpstreamIdle   time.Duration
+		// WebSocketHandshake is the whole upstream WebSocket connection setup, default to 10s.
+		WebSocketHandshake time.Duration
+	}
+)
+
+func (c TimeoutsConfig) validate(errs *ConfigErrors) {
+	timeouts := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"readheader", c.ReadHeader}, {"read", c.Read}, {"write", c.Write}, {"idle", c.Idle},
+		{"dial", c.Dial}, {"tlshandshake", c.TLSHandshake}, {"responseheader", c.ResponseHeader},
+		{"upstreamidle", c.UpstreamIdle}, {"websockethandshake", c.WebSocketHandshake},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			errs.add("timeouts."+t.key, "must not be negative")
+		}
+	}
+}
+
+// configureServer sets the client side timeouts of srv.
+func (c TimeoutsConfig) configureServer(srv *http.Server) {
+	srv.ReadHeaderTimeout = c.ReadHeader
+	srv.ReadTimeout = c.Read
+	srv.WriteTimeout = c.Write
+	srv.IdleTimeout = c.Idle
+}
+
+func (c TimeoutsConfig) upstream() bool {
+	return c.Dial > 0 || c.TLSHandshake > 0 || c.ResponseHeader > 0 || c.UpstreamIdle > 0
+}
+
+// configureTransport sets the upstream timeouts of t, those left 0 keep the value t has.
+func (c TimeoutsConfig) configureTransport(t *http.Transport) {
+	if c.Dial > 0 {
+		t.DialContext = (&net.Dialer{Timeout: c.Dial, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if c.TLSHandshake > 0 {
+		t.TLSHandshakeTimeout = c.TLSHandshake
+	}
+	if c.ResponseHeader > 0 {
+		t.ResponseHeaderTimeout = c.ResponseHeader
+	}
+	if c.UpstreamIdle > 0 {
+		t.IdleConnTimeout = c.UpstreamIdle
+	}
+}
+
+// dial connects to addr within the Dial timeout.
+func (c TimeoutsConfig) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{Timeout: c.Dial}).DialContext(ctx, network, addr)
+}
+
+// dialTLS connects to addr & does the TLS handshake, each within its timeout.
+func (c TimeoutsConfig) dialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := c.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSHandshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TLSHandshake)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			// same as http.Transport, so timeoutPhase tells it
+			return nil, fmt.Errorf("TLS handshake timeout: %w", err)
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (c TimeoutsConfig) webSocketHandshake() time.Duration {
+	if c.WebSocketHandshake == 0 {
+		return defaultWebSocketHandshake
+	}
+	return c.WebSocketHandshake
+}
+
+// timeoutPhase tells which upstream timeout err is about, empty when it's not a timeout.
+func timeoutPhase(err error) string {
+	var opErr *net.OpError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return phaseDial
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return phaseTLSHandshake
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return phaseResponseHeader
+	case isTimeout(err):
+		return phaseUpstream
+	}
+	return ""
+}
+
+// bodyErrorStatus answers a request whose body couldn't be read with err: 408 when the client was too slow.
+func bodyErrorStatus(err error) int {
+	if isTimeout(err) {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded)
+}
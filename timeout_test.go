@@ -0,0 +1,94 @@
+package hdproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTimeoutPhase(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, phaseDial},
+		{fmt.Errorf("TLS handshake timeout: %w", context.DeadlineExceeded), phaseTLSHandshake},
+		{errors.New("net/http: TLS handshake timeout"), phaseTLSHandshake},
+		{errors.New("net/http: timeout awaiting response headers"), phaseResponseHeader},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, phaseUpstream},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ""},
+		{context.Canceled, ""},
+	}
+	for _, tt := range tests {
+		if got := timeoutPhase(tt.err); got != tt.want {
+			t.Errorf("timeoutPhase(%v) got %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamTransport_ResponseHeaderTimeout(t *testing.T) {
+	done := make(chan struct{})
+	// h2c as well, for HTTP/2 upstream
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}), &http2.Server{}))
+	defer srv.Close()
+	defer close(done)
+	for _, protocol := range []string{upstreamAuto, upstreamHTTP1, upstreamHTTP2} {
+		transport := upstreamTransport(protocol, TimeoutsConfig{ResponseHeader: 50 * time.Millisecond})
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		_, err := transport.RoundTrip(req)
+		if err == nil || timeoutPhase(err) != phaseResponseHeader {
+			t.Errorf("%q got %v, want response header timeout", protocol, err)
+		}
+	}
+}
+
+type failingBody struct{ err error }
+
+func (b failingBody) Read([]byte) (int, error) { return 0, b.err }
+
+func TestProxy_RequestBodyError(t *testing.T) {
+	p, err := New(WithConfig(ProxyConfig{
+		Target:      "http://127.0.0.1:1",
+		Mocks:       []MockConfig{{Path: "/mock"}},
+		Breakpoints: []BreakpointConfig{{Path: "^/break"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, http.StatusRequestTimeout},
+		{errors.New("unexpected EOF"), http.StatusBadRequest},
+	}
+	// proxied, mocked & paused at breakpoint
+	for _, path := range []string{"/upload", "/mock", "/break"} {
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, failingBody{tt.err}))
+			if w.Code != tt.want {
+				t.Errorf("%s %v got %d, want %d", path, tt.err, w.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package hdproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pelletier/go-toml/v2"
+)
+
+type (
+	// ConfigError is a single config problem along with where it comes from.
+	ConfigError struct {
+		// Source is the config file, environment variable or flag the value comes from, if known.
+		Source string
+		// Line in Source file, 0 if unknown.
+		Line int
+		// Key is the dotted config key, e.g. "8080.hold".
+		Key string
+		Err error
+	}
+
+	// ConfigErrors collects every problem found, so they can be fixed in one go.
+	ConfigErrors []*ConfigError
+)
+
+func (e *ConfigError) Error() string {
+	var sb strings.Builder
+	switch {
+	case len(e.Source) > 0 && e.Line > 0:
+		sb.WriteString(e.Source + ":" + strconv.Itoa(e.Line) + ": ")
+	case len(e.Source) > 0:
+		sb.WriteString(e.Source + ": ")
+	case e.Line > 0:
+		sb.WriteString("line " + strconv.Itoa(e.Line) + ": ")
+	}
+	if len(e.Key) > 0 {
+		sb.WriteString(e.Key + ": ")
+	}
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (errs ConfigErrors) Error() string {
+	result := make([]string, len(errs))
+	for i, err := range errs {
+		result[i] = err.Error()
+	}
+	return strings.Join(result, "\n")
+}
+
+// add appends a new error for key, prefix of the proxy is added by the caller.
+func (errs *ConfigErrors) add(key string, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{Key: key, Err: fmt.Errorf(format, args...)})
+}
+
+// Validate checks the proxy settings, returned errors have Key relative to the proxy, e.g. "target".
+func (c ProxyConfig) Validate() ConfigErrors {
+	var errs ConfigErrors
+	if len(c.Target) == 0 {
+		errs.add("target", "target is required")
+	} else if _, err := parseTarget(c.Target); err != nil {
+		errs.add("target", "%v", err)
+	}
+	if c.Hold < 0 {
+		errs.add("hold", "must not be negative")
+	}
+	if network, _, err := listenAddress(c.Listen, c.Port); err != nil {
+		errs.add("listen", "%v", err)
+	} else if c.SocketMode != 0 && network != "unix" {
+		errs.add("socketmode", "only for unix socket listen")
+	}
+	if c.SocketMode&^os.ModePerm != 0 {
+		errs.add("socketmode", "invalid permission %#o", uint32(c.SocketMode))
+	}
+	validateProtocols(c, &errs)
+	if _, err := NewGRPCDecoder(c.GRPC); err != nil {
+		errs.add("grpc", "%v", err)
+	}
+	_, mockErrs := compileMocks(c.Mocks)
+	errs = append(errs, mockErrs...)
+	c.Mirror.validate(&errs)
+	c.Cache.validate(&errs)
+	c.Access.validate(&errs)
+	validateLimits(c, &errs)
+	c.Auth.validate(c.TLS.enabled(), &errs)
+	_, breakpointErrs := compileBreakpoints(c.Breakpoints)
+	errs = append(errs, breakpointErrs...)
+	if c.BreakpointTimeout < 0 {
+		errs.add("breakpointtimeout", "must not be negative")
+	}
+	c.Gate.validate(&errs)
+	c.Timeouts.validate(&errs)
+	for _, pattern := range c.NoLog {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs.add("nolog", "invalid regex %q: %v", pattern, err)
+		}
+	}
+	if _, err := NewRedactor(c.Redact); err != nil {
+		errs.add("redact", "%v", err)
+	}
+	return errs
+}
+
+// checkTOML reports syntax error with its line, viper doesn't keep the position.
+func checkTOML(fname string, data []byte) *ConfigError {
+	var doc map[string]interface{}
+	err := toml.Unmarshal(data, &doc)
+	if err == nil {
+		return nil
+	}
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		row, _ := decodeErr.Position()
+		return &ConfigError{Source: fname, Line: row, Err: decodeErr}
+	}
+	return &ConfigError{Source: fname, Err: err}
+}
+
+// indexTOMLLines maps every dotted lowercase key & table in TOML data to its first line.
+// It's not a full parser, just good enough to point where the problem is.
+func indexTOMLLines(data []byte) map[string]int {
+	result := make(map[string]int)
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = normalizeTOMLKey(strings.Trim(line[:end], "[] "))
+			if _, found := result[table]; !found {
+				result[table] = i + 1
+			}
+			continue
+		}
+		key, _, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = normalizeTOMLKey(key)
+		if len(table) > 0 {
+			key = table + "." + key
+		}
+		if _, found := result[key]; !found {
+			result[key] = i + 1
+		}
+	}
+	return result
+}
+
+func normalizeTOMLKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return strings.Join(parts, ".")
+}
+
+// decodeTable decodes every key of table into the matching field of dst (a struct),
+// reporting unknown keys & invalid values into errs with dotted keys under prefix.
+func decodeTable(prefix string, table map[string]interface{}, dst reflect.Value, errs *ConfigErrors) {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fullKey := prefix + "." + key
+		field := fieldByKey(dst, key)
+		if !field.IsValid() {
+			errs.add(fullKey, "unknown key")
+			continue
+		}
+		raw := table[key]
+		switch {
+		case field.Kind() == reflect.Struct:
+			if sub, ok := raw.(map[string]interface{}); ok {
+				decodeTable(fullKey, sub, field, errs)
+				continue
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			if items, ok := raw.([]interface{}); ok {
+				slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+				for i, item := range items {
+					sub, ok := item.(map[string]interface{})
+					if !ok {
+						errs.add(fullKey+"."+strconv.Itoa(i), "expecting a table")
+						continue
+					}
+					decodeTable(fullKey+"."+strconv.Itoa(i), sub, slice.Index(i), errs)
+				}
+				field.Set(slice)
+				continue
+			}
+		}
+		if err := decodeValue(raw, field.Addr().Interface()); err != nil {
+			errs.add(fullKey, "%v", err)
+		}
+	}
+}
+
+// stringToListHook splits strings into slices by comma like mapstructure.StringToSliceHookFunc does,
+// except commas within brackets so regexes like ^/a{1,3} stay whole, e.g. from HDPROXY_<PORT>_NOLOG.
+func stringToListHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Slice {
+		return data, nil
+	}
+	s := data.(string)
+	if len(s) == 0 {
+		return []string{}, nil
+	}
+	return splitList(s), nil
+}
+
+// splitList splits s by commas outside of (), {} & [], backslash escapes the next character.
+func splitList(s string) []string {
+	var result []string
+	depth, start := 0, 0
+	inClass := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(' || c == '{':
+			depth++
+		case (c == ')' || c == '}') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// decodeValue decodes raw config value the same way viper does.
+func decodeValue(raw interface{}, result interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			stringToListHook,
+		),
+		WeaklyTypedInput: true,
+		Result:           result,
+	})
+	if err != nil {
+		return err
+	}
+	err = decoder.Decode(raw)
+	var decodeErr *mapstructure.Error
+	if errors.As(err, &decodeErr) {
+		msgs := make([]string, len(decodeErr.Errors))
+		for i, msg := range decodeErr.Errors {
+			msgs[i] = strings.TrimPrefix(msg, "error decoding '': ")
+		}
+		return errors.New(strings.Join(msgs, ", "))
+	}
+	if err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "error decoding '': "))
+	}
+	return nil
+}
+
+// fieldByKey finds the exported field of struct v named key, case insensitive like viper.
+func fieldByKey(v reflect.Value, key string) reflect.Value {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() && strings.EqualFold(t.Field(i).Name, key) {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// PrintConfig writes config in TOML format, only non-zero values are written.
+// Admin token is left out & auth passwords and tokens are masked, they're secrets.
+func PrintConfig(w io.Writer, config Config) {
+	if len(config.Admin.Addr) > 0 {
+		fmt.Fprintf(w, "[admin]\nAddr = %s\n\n", tomlQuote(config.Admin.Addr))
+	}
+	for i, proxy := range config.Proxies {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		proxy.Auth.Basic = maskCredentials(proxy.Auth.Basic)
+		proxy.Auth.Bearer = maskCredentials(proxy.Auth.Bearer)
+		if len(proxy.Redact.HashKey) > 0 {
+			proxy.Redact.HashKey = redactMask
+		}
+		if len(proxy.Name) > 0 {
+			printTOMLTable(w, "proxies."+tomlKey(proxy.Name), reflect.ValueOf(proxy), false)
+		} else {
+			name := strconv.Itoa(proxy.Port)
+			proxy.Port = 0 // taken from the section name
+			printTOMLTable(w, name, reflect.ValueOf(proxy), false)
+		}
+	}
+}
+
+// maskCredentials returns a copy of "name:secret" credentials with the secret masked.
+func maskCredentials(credentials []string) []string {
+	if credentials == nil {
+		return nil
+	}
+	result := make([]string, len(credentials))
+	for i, credential := range credentials {
+		name, _, _ := strings.Cut(credential, ":")
+		result[i] = name + ":" + redactMask
+	}
+	return result
+}
+
+func printTOMLTable(w io.Writer, name string, v reflect.Value, arrayItem bool) {
+	if arrayItem {
+		fmt.Fprintf(w, "[[%s]]\n", name)
+	} else {
+		fmt.Fprintf(w, "[%s]\n", name)
+	}
+	t := v.Type()
+	var tables []int
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if !t.Field(i).IsExported() || t.Field(i).Name == "Name" || field.IsZero() {
+			continue
+		}
+		if field.Kind() == reflect.Struct || field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			tables = append(tables, i)
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", t.Field(i).Name, tomlValue(field))
+	}
+	for _, i := range tables {
+		field := v.Field(i)
+		subName := name + "." + t.Field(i).Name
+		if field.Kind() == reflect.Struct {
+			printTOMLTable(w, subName, field, false)
+			continue
+		}
+		for j := 0; j < field.Len(); j++ {
+			printTOMLTable(w, subName, field.Index(j), true)
+		}
+	}
+}
+
+func tomlValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return tomlQuote(value.String())
+	case os.FileMode:
+		return tomlQuote(fmt.Sprintf("%#o", uint32(value)))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return tomlQuote(v.String())
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = tomlValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = tomlQuote(key.String()) + " = " + tomlValue(v.MapIndex(key))
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// tomlKey quotes key only if it's not a valid bare key.
+func tomlKey(key string) string {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return tomlQuote(key)
+		}
+	}
+	return key
+}
+
+func tomlQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, "\\u%04X", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func envConfigName(key string) string {
+	return "HDPROXY_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func isEnvSet(name string) bool {
+	_, found := os.LookupEnv(name)
+	return found
+}